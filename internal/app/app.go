@@ -27,6 +27,7 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	v1 "github.com/webmeshproj/api/v1"
 )
@@ -58,22 +59,108 @@ type App struct {
 	connecting atomic.Bool
 	// connected indicates if the app is currently connected to the mesh.
 	connected atomic.Bool
+	// connectedBefore indicates if the app has connected to the mesh since it started.
+	connectedBefore atomic.Bool
+	// connectState is the value of the connect switch.
+	connectState binding.Float
+	// quotas tracks bandwidth usage against the configured quotas.
+	quotas *quotaTracker
+	// foreground indicates if the app is currently in the foreground.
+	foreground atomic.Bool
+	// peersVisible is true while the peers tab is shown.
+	peersVisible atomic.Bool
+	// metricsPollWake is signalled to make the metrics poller poll immediately.
+	metricsPollWake chan struct{}
+	// metrics are the metrics collected by the app.
+	metrics *appMetrics
 	// newPSKButton is the button for creating a new PSK.
 	newPSKButton *widget.Button
 	// roomsList is the list of rooms.
 	roomsList binding.StringList
 	// roomsListWidget is the widget containing the list of rooms.
 	roomsListWidget *widget.List
+	// directList is the list of nodes we have direct messages with.
+	directList binding.StringList
+	// directListWidget is the widget containing the list of direct messages.
+	directListWidget *widget.List
 	// chatContainer is the container for the chat room.
 	chatContainer *fyne.Container
-	// chatText is the grid for the chat text.
-	chatText *widget.TextGrid
+	// chatView is the view of the selected room's transcript.
+	chatView *chatView
+	// chatHeader is the label above the chat view describing the selected room.
+	chatHeader *widget.Label
+	// chatMembers are the node IDs of the selected room's members.
+	chatMembers binding.StringList
+	// chatMembersList is the widget listing the selected room's members.
+	chatMembersList *widget.List
+	// rooms holds the info of known rooms and the keys of encrypted ones.
+	rooms *roomDirectory
+	// attachments caches the images of attachments shown as thumbnails.
+	attachments *attachmentCache
+	// profiles are the profiles published by nodes in the mesh.
+	profiles *profileDirectory
+	// invites holds the direct message invites from nodes whose profiles we have not seen.
+	invites pendingInvites
+	// search indexes the messages seen in joined rooms.
+	search *searchIndex
+	// searchPanel is the side panel for searching messages.
+	searchPanel *fyne.Container
+	// refreshSearchFilters refreshes the room and sender filters of the search panel.
+	refreshSearchFilters func()
+	// jumpTo is the key of a message to scroll to when the next room is opened.
+	jumpTo string
+	// unread counts the messages received in rooms that are not being viewed.
+	unread *unreadCounts
+	// muteButton mutes and unmutes notifications for the selected room.
+	muteButton *widget.Button
+	// presence tracks the presence of the selected room's members.
+	presence *roomPresence
+	// typingLabel shows which members of the selected room are typing.
+	typingLabel *widget.Label
+	// lastActivity is the time of our last input, in nanoseconds since the epoch.
+	lastActivity atomic.Int64
+	// lastTyping is when we last published a typing marker, in nanoseconds since the epoch.
+	lastTyping atomic.Int64
+	// transcript is the transcript of the selected room. It is read from the room
+	// subscription, so it is only accessed atomically.
+	transcript atomic.Pointer[chatTranscript]
+	// loadingHistory indicates if a page of room history is currently being loaded.
+	loadingHistory atomic.Bool
 	// chatGrid is the container containg the chat text and input.
 	chatGrid *fyne.Container
 	// chatInput is the input for the chat.
-	chatInput *widget.Entry
-	// joinRooms is the list of joined rooms.
-	joinRooms []string
+	chatInput *chatInputEntry
+	// replyingTo is the entry being replied to from the chat input, if any.
+	replyingTo *chatEntry
+	// replyBar shows the message being replied to above the chat input.
+	replyBar *fyne.Container
+	// replyLabel quotes the message being replied to.
+	replyLabel *widget.Label
+	// threadPanel is the side panel showing a thread of replies.
+	threadPanel *fyne.Container
+	// threadView is the view of the open thread.
+	threadView *chatView
+	// threadInput is the input for replies to the open thread.
+	threadInput *chatInputEntry
+	// threadParent is the ID of the message that started the open thread.
+	threadParent string
+	// throughput tracks the transfer rates of the mesh interface.
+	throughput *throughputTracker
+	// throughputGraph is the graph of the transfer rates.
+	throughputGraph *sparkline
+	// throughputWindow is the duration of samples shown in the throughput graph.
+	throughputWindow atomic.Int64
+	// history is the on-disk history of interface metrics. It is nil if it could not be opened.
+	history *metricsHistory
+	// chatHistory is the on-disk history of rooms and messages. It is nil if it is
+	// disabled, locked or could not be opened.
+	chatHistory atomic.Pointer[chatStore]
+	// verified caches the verification status of messages shown in the chat.
+	verified verifyCache
+	// keys caches our signing and direct message keys.
+	keys identityKeys
+	// peers is the view of per-peer statistics.
+	peers *peersView
 	// selectedRoom is the currently selected room.
 	selectedRoom string
 	// log is the application logger.
@@ -91,10 +178,25 @@ func New(socketAddr string) *App {
 		joinPSK:                 binding.NewString(),
 		newPSKButton:            widget.NewButton("Generate PSK", func() {}),
 		roomsList:               binding.NewStringList(),
-		chatText:                widget.NewTextGrid(),
-		chatInput:               widget.NewEntry(),
+		directList:              binding.NewStringList(),
+		chatHeader:              widget.NewLabel(""),
+		chatMembers:             binding.NewStringList(),
+		typingLabel:             widget.NewLabel(""),
+		profiles:                newProfileDirectory(),
+		rooms:                   newRoomDirectory(),
+		attachments:             newAttachmentCache(),
+		unread:                  newUnreadCounts(),
+		search:                  newSearchIndex(),
+		cancelRoomSubscription:  func() {},
+		chatInput:               newChatInputEntry(),
+		replyLabel:              widget.NewLabel(""),
+		threadInput:             newChatInputEntry(),
 		cancelNodeSubscriptions: func() {},
 		cancelConnect:           func() {},
+		metricsPollWake:         make(chan struct{}, 1),
+		metrics:                 newAppMetrics(),
+		throughput:              &throughputTracker{},
+		throughputGraph:         newSparkline(rateString, theme.PrimaryColor(), theme.SuccessColor()),
 		log:                     slog.Default(),
 	}
 	if socketAddr != "" {
@@ -102,8 +204,14 @@ func New(socketAddr string) *App {
 	} else {
 		nodeSocket.Set(app.Preferences().StringWithFallback(preferenceNodeSocket, "tcp://127.0.0.1:8080"))
 	}
+	app.markActive()
+	app.search.honor = app.honorRevision
+	app.quotas = newQuotaTracker(app.Preferences())
+	app.openHistory()
 	app.setup()
+	app.applyMetricsServer()
 	app.main.Show()
+	app.openChatHistory()
 	return app
 }
 
@@ -112,12 +220,17 @@ func (app *App) setup() {
 	app.main.Resize(fyne.NewSize(800, 600))
 	app.main.SetCloseIntercept(app.closeIntercept)
 	app.main.SetMainMenu(app.newMainMenu())
+	app.peers = newPeersView(app.main)
+	app.foreground.Store(true)
+	app.Lifecycle().SetOnEnteredForeground(app.onForegroundChange(true))
+	app.Lifecycle().SetOnExitedForeground(app.onForegroundChange(false))
 
 	// Header section
 	connectedText := binding.NewString()
 	connectedText.Set("Disconnected")
 	connectedLabel := widget.NewLabelWithData(connectedText)
 	connectSwitch, connected := newConnectSwitch()
+	app.connectState = connected
 	connected.AddListener(binding.NewDataListener(app.onConnectChange(connectedText, connected)))
 	pskEntry := widget.NewEntryWithData(app.joinPSK)
 	pskEntry.Wrapping = fyne.TextWrapOff
@@ -146,30 +259,85 @@ func (app *App) setup() {
 	ifaceLabel.TextStyle.Bold = true
 	sentLabel.TextStyle.Bold = true
 	rcvdLabel.TextStyle.Bold = true
+	sendRateLabel := widget.NewLabel("Send Rate")
+	recvRateLabel := widget.NewLabel("Receive Rate")
+	throughputLabel := widget.NewLabel("Throughput")
+	sendRateLabel.TextStyle.Bold = true
+	recvRateLabel.TextStyle.Bold = true
+	throughputLabel.TextStyle.Bold = true
+	throughputWindow := widget.NewRadioGroup(throughputWindowOptions, func(s string) {
+		if d, ok := throughputWindows[s]; ok {
+			app.throughputWindow.Store(int64(d))
+			app.refreshThroughputGraph()
+		}
+	})
+	throughputWindow.Horizontal = true
+	throughputWindow.Required = true
+	throughputWindow.SetSelected(throughputWindowOptions[0])
 
 	// Chat rooms
 	newRoomLabel := func() fyne.CanvasObject { return widget.NewLabel("") }
 	renderRoom := func(item binding.DataItem, obj fyne.CanvasObject) {
-		obj.(*widget.Label).Bind(item.(binding.String))
+		roomName, _ := item.(binding.String).Get()
+		obj.(*widget.Label).SetText(app.roomLabel(roomName))
 	}
 	app.roomsListWidget = widget.NewListWithData(app.roomsList, newRoomLabel, renderRoom)
 	app.roomsListWidget.OnSelected = app.onRoomSelected
 	app.roomsListWidget.OnUnselected = app.onRoomUnselected
 	roomsTop := container.New(layout.NewVBoxLayout(),
 		widget.NewButton("New Room", app.onNewChatRoom),
+		widget.NewButtonWithIcon("Search", theme.SearchIcon(), app.toggleSearch),
 		widget.NewLabel("Chat Rooms"))
-	roomsContainer := container.New(layout.NewBorderLayout(roomsTop, nil, nil, nil),
-		roomsTop,
-		app.roomsListWidget,
+	app.directListWidget = app.newDirectListWidget()
+	directTop := container.New(layout.NewVBoxLayout(),
+		widget.NewButton("New Direct Message", app.onNewDirectMessage),
+		widget.NewLabel("Direct Messages"))
+	roomsContainer := container.NewVSplit(
+		container.New(layout.NewBorderLayout(roomsTop, nil, nil, nil), roomsTop, app.roomsListWidget),
+		container.New(layout.NewBorderLayout(directTop, nil, nil, nil), directTop, app.directListWidget),
 	)
 	roomBox := container.New(layout.NewHBoxLayout(), roomsContainer, widget.NewSeparator())
 	app.chatInput.SetPlaceHolder("Enter message")
 	app.chatInput.OnSubmitted = app.onSendMessage
-	app.chatInput.Wrapping = fyne.TextWrapWord
-	app.chatGrid = container.New(layout.NewBorderLayout(nil, app.chatInput, nil, nil), app.chatText, app.chatInput)
-	app.chatContainer = container.New(layout.NewBorderLayout(nil, nil, roomBox, nil),
+	app.chatInput.OnChanged = app.onChatInputChanged
+	app.typingLabel.TextStyle = fyne.TextStyle{Italic: true}
+	app.chatView = newChatView(app.nodeID, app.profiles)
+	app.chatView.OnScrolledToTop = app.onChatScrolledToTop
+	app.chatView.OnScrolledToBottom = app.onChatScrolledToBottom
+	app.chatView.OnFollowChanged = app.onChatFollowChanged
+	app.chatView.Menu = app.chatEntryMenu
+	app.chatView.Verify = app.verifyMessage
+	app.chatView.Thumbnail = app.thumbnail
+	app.chatView.ReactionMenu = app.reactionMenu
+	app.chatView.CopyText = app.copyText
+	app.chatView.OpenThread = app.openThread
+	membersPanel := app.newChatMembersPanel()
+	threadPanel := app.newThreadPanel()
+	app.profiles.OnChanged = app.onProfilesChanged
+	attachButton := widget.NewButtonWithIcon("", theme.FileIcon(), app.onAttachFile)
+	inputButtons := container.New(layout.NewHBoxLayout(), attachButton, app.newMarkdownCheck())
+	app.replyLabel.TextStyle = fyne.TextStyle{Italic: true}
+	app.replyLabel.Wrapping = fyne.TextTruncate
+	cancelReplyButton := widget.NewButtonWithIcon("", theme.CancelIcon(), app.cancelReply)
+	app.replyBar = container.New(layout.NewBorderLayout(nil, nil, nil, cancelReplyButton), cancelReplyButton, app.replyLabel)
+	app.replyBar.Hide()
+	inputRow := container.New(layout.NewVBoxLayout(),
+		app.typingLabel,
+		app.replyBar,
+		container.New(layout.NewBorderLayout(nil, nil, nil, inputButtons), inputButtons, app.chatInput),
+	)
+	leaveButton := widget.NewButton("Leave", app.onLeaveRoom)
+	app.muteButton = widget.NewButton("Mute", app.onToggleMute)
+	headerButtons := container.New(layout.NewHBoxLayout(), app.muteButton, leaveButton)
+	headerRow := container.New(layout.NewBorderLayout(nil, nil, nil, headerButtons), headerButtons, app.chatHeader)
+	sidePanels := container.New(layout.NewHBoxLayout(), threadPanel, membersPanel)
+	app.chatGrid = container.New(layout.NewBorderLayout(headerRow, inputRow, nil, sidePanels),
+		headerRow, app.chatView, inputRow, sidePanels)
+	searchPanel := app.newSearchPanel()
+	app.chatContainer = container.New(layout.NewBorderLayout(nil, nil, roomBox, searchPanel),
 		roomBox,
 		app.chatGrid,
+		searchPanel,
 	)
 	app.chatGrid.Hide()
 	app.chatContainer.Hide()
@@ -181,19 +349,30 @@ func (app *App) setup() {
 			sentLabel, widget.NewLabelWithData(totalSentBytes), layout.NewSpacer()),
 		container.New(layout.NewHBoxLayout(),
 			rcvdLabel, widget.NewLabelWithData(totalRecvBytes), layout.NewSpacer()),
+		container.New(layout.NewHBoxLayout(),
+			sendRateLabel, widget.NewLabelWithData(sendRate), legendSwatch(theme.PrimaryColor()),
+			recvRateLabel, widget.NewLabelWithData(recvRate), legendSwatch(theme.SuccessColor()),
+			layout.NewSpacer(), throughputLabel, throughputWindow),
+		app.throughputGraph,
 		widget.NewSeparator(),
 	)
-	resetConnectedValues()
-	top := container.New(layout.NewVBoxLayout(), header, body)
+	app.resetConnectedValues()
+	top := container.New(layout.NewVBoxLayout(), header, app.newNodeInfoPanel(), body)
+	tabs := container.NewAppTabs(
+		container.NewTabItem("Chat", app.chatContainer),
+		container.NewTabItem(peersTabName, app.peers.content()),
+	)
+	tabs.OnSelected = app.onTabSelected
 	app.main.SetContent(container.New(layout.NewBorderLayout(top, nil, nil, nil),
 		top,
-		app.chatContainer,
+		tabs,
 	))
 }
 
 // closeIntercept is fired before the main window is closed.
 func (app *App) closeIntercept() {
 	defer app.main.Close()
+	defer app.metrics.shutdown()
 	if app.connected.Load() {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 		defer cancel()
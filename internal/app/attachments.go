@@ -0,0 +1,405 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // Register GIF thumbnails
+	_ "image/jpeg" // Register JPEG thumbnails
+	_ "image/png"  // Register PNG thumbnails
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	v1 "github.com/webmeshproj/api/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// ContentTypeAttachment is the content type of messages announcing an attachment.
+	// The body is an AttachmentManifest.
+	ContentTypeAttachment = "application/x-webmesh-attachment"
+	// maxAttachmentSize is the largest file that can be attached.
+	maxAttachmentSize = 8 << 20
+	// attachmentChunkSize is the size of each published chunk of an attachment.
+	attachmentChunkSize = 32 << 10
+	// maxCachedThumbnails is the most decoded image attachments kept in memory.
+	maxCachedThumbnails = 32
+	// maxThumbnailPixels is the most pixels an image attachment may have to be shown.
+	maxThumbnailPixels = 4096 * 4096
+)
+
+// AttachmentsPath returns the storage path for a room's attachments.
+func AttachmentsPath(roomName string) string {
+	return path.Join(RoomPath(roomName), "attachments")
+}
+
+// AttachmentChunkPath returns the storage path of a chunk of an attachment.
+func AttachmentChunkPath(roomName, id string, n int) string {
+	return path.Join(AttachmentsPath(roomName), id, strconv.Itoa(n))
+}
+
+// AttachmentManifest describes an attachment whose chunks are published under the
+// room's attachments path.
+type AttachmentManifest struct {
+	// ID is the unique ID of the attachment.
+	ID string `json:"id"`
+	// Name is the file name of the attachment.
+	Name string `json:"name"`
+	// Size is the size of the attachment in bytes.
+	Size int64 `json:"size"`
+	// MIMEType is the MIME type of the attachment.
+	MIMEType string `json:"mimeType"`
+	// SHA256 is the hex encoded SHA-256 hash of the attachment.
+	SHA256 string `json:"sha256"`
+	// Chunks is the number of chunks the attachment is split into.
+	Chunks int `json:"chunks"`
+}
+
+// attachmentManifest returns the manifest of an attachment message, or nil if the
+// message is not a valid attachment.
+func (m *ChatMessage) attachmentManifest() *AttachmentManifest {
+	if m.ContentType != ContentTypeAttachment {
+		return nil
+	}
+	var manifest AttachmentManifest
+	if err := json.Unmarshal([]byte(m.Body), &manifest); err != nil || manifest.ID == "" {
+		return nil
+	}
+	if manifest.Size < 0 || manifest.Size > maxAttachmentSize || manifest.Chunks != attachmentChunks(manifest.Size) {
+		return nil
+	}
+	manifest.Name = filepath.Base(manifest.Name)
+	return &manifest
+}
+
+// attachmentChunks returns the number of chunks an attachment of the given size is
+// split into. Empty attachments have one empty chunk.
+func attachmentChunks(size int64) int {
+	if size == 0 {
+		return 1
+	}
+	return int((size + attachmentChunkSize - 1) / attachmentChunkSize)
+}
+
+// isImage returns true if the attachment can be shown as a thumbnail.
+func (a *AttachmentManifest) isImage() bool {
+	switch a.MIMEType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	default:
+		return false
+	}
+}
+
+// attachmentCache holds decoded image attachments for thumbnails.
+type attachmentCache struct {
+	mu      sync.Mutex
+	images  map[string]image.Image
+	order   []string
+	loading map[string]bool
+	// failed holds attachments that could not be loaded, so that they are not fetched again.
+	failed map[string]struct{}
+}
+
+func newAttachmentCache() *attachmentCache {
+	return &attachmentCache{
+		images:  make(map[string]image.Image),
+		loading: make(map[string]bool),
+		failed:  make(map[string]struct{}),
+	}
+}
+
+// thumbnail returns the decoded image of an attachment message. If it is not loaded
+// yet, nil is returned and it is loaded in the background.
+func (app *App) thumbnail(e *chatEntry) image.Image {
+	manifest := e.current().attachmentManifest()
+	if manifest == nil || !manifest.isImage() {
+		return nil
+	}
+	cache := app.attachments
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if img, ok := cache.images[manifest.ID]; ok {
+		return img
+	}
+	if _, ok := cache.failed[manifest.ID]; ok || cache.loading[manifest.ID] {
+		return nil
+	}
+	cache.loading[manifest.ID] = true
+	roomName := roomFromKey(e.key)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		data, err := app.fetchAttachment(ctx, roomName, manifest, nil)
+		var img image.Image
+		if err == nil {
+			img, err = decodeThumbnail(data)
+		}
+		if err != nil {
+			app.log.Error("error loading attachment thumbnail", "name", manifest.Name, "error", err.Error())
+		}
+		cache.mu.Lock()
+		delete(cache.loading, manifest.ID)
+		if img != nil {
+			cache.images[manifest.ID] = img
+			cache.order = append(cache.order, manifest.ID)
+			if len(cache.order) > maxCachedThumbnails {
+				delete(cache.images, cache.order[0])
+				cache.order = cache.order[1:]
+			}
+		} else {
+			cache.failed[manifest.ID] = struct{}{}
+		}
+		cache.mu.Unlock()
+		if img != nil {
+			app.chatView.refreshRows()
+			if app.threadView != nil {
+				app.threadView.refreshRows()
+			}
+		}
+	}()
+	return nil
+}
+
+// decodeThumbnail decodes an image attachment, refusing images with more pixels than
+// are allowed for thumbnails before decoding them.
+func decodeThumbnail(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxThumbnailPixels {
+		return nil, fmt.Errorf("image is larger than %d pixels", maxThumbnailPixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// onAttachFile asks for a file and attaches it to the selected room.
+func (app *App) onAttachFile() {
+	if app.selectedRoom == "" {
+		return
+	}
+	roomName := app.selectedRoom
+	dialog.ShowFileOpen(func(r fyne.URIReadCloser, err error) {
+		if err != nil {
+			app.log.Error("error opening attachment", "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
+		if r == nil {
+			return
+		}
+		defer r.Close()
+		data, err := io.ReadAll(io.LimitReader(r, maxAttachmentSize+1))
+		if err != nil {
+			app.log.Error("error reading attachment", "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
+		if len(data) > maxAttachmentSize {
+			dialog.ShowError(fmt.Errorf("attachments cannot be larger than %s", bytesString(maxAttachmentSize)), app.main)
+			return
+		}
+		go app.sendAttachment(roomName, r.URI().Name(), data)
+	}, app.main)
+}
+
+// sendAttachment publishes the chunks of a file to a room followed by a message
+// announcing it. Progress is shown while the chunks are published.
+func (app *App) sendAttachment(roomName, name string, data []byte) {
+	nodeID, _ := app.nodeID.Get()
+	msg, err := NewChatMessage(nodeID, ContentTypeAttachment, "")
+	if err != nil {
+		app.log.Error("error creating message", "error", err.Error())
+		return
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	sum := sha256.Sum256(data)
+	manifest := &AttachmentManifest{
+		ID:       msg.ID,
+		Name:     name,
+		Size:     int64(len(data)),
+		MIMEType: mimeType,
+		SHA256:   hex.EncodeToString(sum[:]),
+		Chunks:   attachmentChunks(int64(len(data))),
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		app.log.Error("error encoding attachment manifest", "error", err.Error())
+		return
+	}
+	msg.Body = string(body)
+	var ttl time.Duration
+	if info := app.rooms.info(roomName); info != nil {
+		ttl = info.ttl()
+	}
+	progress := dialog.NewProgress("Sending Attachment", name, app.main)
+	progress.Show()
+	defer progress.Hide()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+	for n := 0; n < manifest.Chunks; n++ {
+		end := (n + 1) * attachmentChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		key := AttachmentChunkPath(roomName, manifest.ID, n)
+		value, err := app.sealChunk(roomName, key, data[n*attachmentChunkSize:end])
+		if err == nil {
+			err = app.doPublish(ctx, &v1.PublishRequest{
+				Key:   key,
+				Value: value,
+				Ttl:   durationpb.New(ttl),
+			})
+		}
+		if err != nil {
+			app.log.Error("error sending attachment", "name", name, "error", err.Error())
+			dialog.ShowError(fmt.Errorf("failed to send attachment: %w", err), app.main)
+			return
+		}
+		progress.SetValue(float64(n+1) / float64(manifest.Chunks))
+	}
+	if err := app.sendMessage(ctx, roomName, msg); err != nil {
+		app.log.Error("error sending attachment", "name", name, "error", err.Error())
+		dialog.ShowError(fmt.Errorf("failed to send attachment: %w", err), app.main)
+	}
+}
+
+// sealChunk returns the value to publish for a chunk of an attachment, sealing it if
+// the room is encrypted.
+func (app *App) sealChunk(roomName, key string, chunk []byte) (string, error) {
+	info := app.rooms.info(roomName)
+	if info == nil || !info.Encrypted {
+		return base64.StdEncoding.EncodeToString(chunk), nil
+	}
+	roomKey := app.rooms.key(roomName)
+	if roomKey == nil {
+		return "", errRoomLocked
+	}
+	return sealRoomValue(roomKey, chunk, key)
+}
+
+// openChunk returns the contents of a published chunk of an attachment.
+func (app *App) openChunk(roomName, key, value string) ([]byte, error) {
+	info := app.rooms.info(roomName)
+	if info == nil || !info.Encrypted {
+		return base64.StdEncoding.DecodeString(value)
+	}
+	roomKey := app.rooms.key(roomName)
+	if roomKey == nil {
+		return nil, errRoomLocked
+	}
+	return openRoomValue(roomKey, value, key)
+}
+
+// fetchAttachment fetches the chunks of an attachment and verifies its hash. The
+// progress function is called after each chunk if it is not nil.
+func (app *App) fetchAttachment(ctx context.Context, roomName string, manifest *AttachmentManifest, progress func(float64)) ([]byte, error) {
+	if manifest.Size > maxAttachmentSize {
+		return nil, fmt.Errorf("attachment is larger than %s", bytesString(maxAttachmentSize))
+	}
+	c, err := app.dialNode(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial node: %w", err)
+	}
+	defer c.Close()
+	cli := v1.NewAppDaemonClient(c)
+	data := make([]byte, 0, manifest.Size)
+	for n := 0; n < manifest.Chunks; n++ {
+		key := AttachmentChunkPath(roomName, manifest.ID, n)
+		value, err := queryValue(ctx, cli, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch chunk %d: %w", n, err)
+		}
+		chunk, err := app.openChunk(roomName, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open chunk %d: %w", n, err)
+		}
+		data = append(data, chunk...)
+		if int64(len(data)) > manifest.Size {
+			return nil, errors.New("attachment is larger than its manifest")
+		}
+		if progress != nil {
+			progress(float64(n+1) / float64(manifest.Chunks))
+		}
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != manifest.Size || !strings.EqualFold(hex.EncodeToString(sum[:]), manifest.SHA256) {
+		return nil, errors.New("attachment failed integrity check")
+	}
+	return data, nil
+}
+
+// onSaveAttachment downloads an attachment and asks where to save it.
+func (app *App) onSaveAttachment(e *chatEntry) {
+	manifest := e.current().attachmentManifest()
+	if manifest == nil {
+		return
+	}
+	roomName := roomFromKey(e.key)
+	go func() {
+		progress := dialog.NewProgress("Downloading Attachment", manifest.Name, app.main)
+		progress.Show()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		defer cancel()
+		data, err := app.fetchAttachment(ctx, roomName, manifest, progress.SetValue)
+		progress.Hide()
+		if err != nil {
+			app.log.Error("error downloading attachment", "name", manifest.Name, "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
+		save := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+			if err != nil {
+				app.log.Error("error saving attachment", "error", err.Error())
+				dialog.ShowError(err, app.main)
+				return
+			}
+			if w == nil {
+				return
+			}
+			defer w.Close()
+			if _, err := w.Write(data); err != nil {
+				app.log.Error("error saving attachment", "error", err.Error())
+				dialog.ShowError(err, app.main)
+			}
+		}, app.main)
+		save.SetFileName(manifest.Name)
+		save.Show()
+	}()
+}
@@ -19,6 +19,7 @@ package app
 import (
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -28,8 +29,11 @@ import (
 	"time"
 
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	v1 "github.com/webmeshproj/api/v1"
 	"google.golang.org/protobuf/types/known/durationpb"
@@ -104,14 +108,75 @@ func (app *App) listRooms() ([]string, error) {
 	for _, r := range result.GetValue() {
 		r = strings.TrimPrefix(r, RoomsPrefix+"/")
 		parts := strings.Split(r, "/")
-		if len(parts) != 1 {
+		// Direct messages are listed separately.
+		if len(parts) != 1 || isDirectRoom(parts[0]) {
 			continue
 		}
 		rooms = append(rooms, parts[0])
 	}
+	cli := v1.NewAppDaemonClient(c)
+	for _, roomName := range rooms {
+		if _, err := app.fetchRoomInfo(ctx, cli, roomName); err != nil {
+			app.log.Error("error fetching room info", "room", roomName, "error", err.Error())
+		}
+	}
 	return rooms, nil
 }
 
+// refreshRoomInfo fetches the info of a room.
+func (app *App) refreshRoomInfo(roomName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	c, err := app.dialNode(ctx)
+	if err != nil {
+		app.log.Error("error dialing node", "error", err.Error())
+		return
+	}
+	defer c.Close()
+	if _, err := app.fetchRoomInfo(ctx, v1.NewAppDaemonClient(c), roomName); err != nil {
+		app.log.Error("error fetching room info", "room", roomName, "error", err.Error())
+	}
+}
+
+// roomTitle returns the title shown above the transcript of a room.
+func (app *App) roomTitle(roomName string) string {
+	if isDirectRoom(roomName) {
+		if peerID := app.directPeerForRoom(roomName); peerID != "" {
+			name, _ := app.profiles.name(peerID)
+			return fmt.Sprintf("Direct messages with %s", name)
+		}
+	}
+	return fmt.Sprintf("Room: %s", roomName)
+}
+
+// roomLabel returns the label for a room in the rooms list.
+func (app *App) roomLabel(roomName string) string {
+	badge := app.unread.badge(roomName)
+	switch info := app.rooms.info(roomName); {
+	case info == nil || !info.Encrypted:
+		return roomName + badge
+	case app.rooms.locked(roomName):
+		return roomName + " (locked)" + badge
+	default:
+		return roomName + " (encrypted)" + badge
+	}
+}
+
+// validateRoomName returns an error if a room name cannot be used for a new room.
+// Names starting with @ are kept for direct messages, slashes would change the
+// storage path of the room and commas separate rooms in saved lists.
+func validateRoomName(s string) error {
+	switch {
+	case strings.TrimSpace(s) == "":
+		return errors.New("room name cannot be empty")
+	case strings.HasPrefix(s, directRoomPrefix):
+		return fmt.Errorf("room name cannot start with %s", directRoomPrefix)
+	case strings.ContainsAny(s, "/,"):
+		return errors.New("room name cannot contain / or ,")
+	}
+	return nil
+}
+
 func (app *App) onNewChatRoom() {
 	if app.chatContainer.Hidden {
 		return
@@ -119,8 +184,8 @@ func (app *App) onNewChatRoom() {
 	roomName := widget.NewEntry()
 	roomName.Wrapping = fyne.TextWrapOff
 	roomName.Validator = func(s string) error {
-		if strings.TrimSpace(s) == "" {
-			return errors.New("room name cannot be empty")
+		if err := validateRoomName(s); err != nil {
+			return err
 		}
 		current, _ := app.roomsList.Get()
 		for _, r := range current {
@@ -140,9 +205,47 @@ func (app *App) onNewChatRoom() {
 		_, err := time.ParseDuration(s)
 		return err
 	}
+	passphrase := widget.NewPasswordEntry()
+	passphrase.SetPlaceHolder("Passphrase or shared key")
+	passphrase.Disable()
+	generateKey := widget.NewButton("Generate Key", func() {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			dialog.ShowError(err, app.main)
+			return
+		}
+		passphrase.SetText(base64.RawURLEncoding.EncodeToString(key))
+	})
+	generateKey.Disable()
+	copyKey := widget.NewButtonWithIcon("", theme.ContentCopyIcon(), func() {
+		if passphrase.Text != "" {
+			app.main.Clipboard().SetContent(passphrase.Text)
+		}
+	})
+	copyKey.Disable()
+	encrypted := widget.NewCheck("Encrypted", func(checked bool) {
+		if checked {
+			passphrase.Enable()
+			generateKey.Enable()
+			copyKey.Enable()
+		} else {
+			passphrase.Disable()
+			generateKey.Disable()
+			copyKey.Disable()
+		}
+	})
+	keyButtons := container.New(layout.NewHBoxLayout(), generateKey, copyKey)
+	passphrase.Validator = func(s string) error {
+		if encrypted.Checked && s == "" {
+			return errors.New("passphrase cannot be empty")
+		}
+		return nil
+	}
 	dialog.ShowForm("New Chat Room", "Create", "Cancel", []*widget.FormItem{
 		widget.NewFormItem("Room Name", roomName),
 		widget.NewFormItem("Self Destruct", selfDestruct),
+		widget.NewFormItem("", encrypted),
+		widget.NewFormItem("Passphrase", container.New(layout.NewBorderLayout(nil, nil, nil, keyButtons), keyButtons, passphrase)),
 	}, func(ok bool) {
 		if !ok {
 			return
@@ -152,29 +255,49 @@ func (app *App) onNewChatRoom() {
 		if strings.TrimSpace(selfDestruct.Text) != "" {
 			ttl, _ = time.ParseDuration(selfDestruct.Text)
 		}
+		info := &RoomInfo{Version: RoomInfoVersion}
+		if ttl > 0 {
+			info.TTL = ttl.String()
+		}
+		var roomKey []byte
+		if encrypted.Checked {
+			var err error
+			info, roomKey, err = newEncryptedRoomInfo(roomName, passphrase.Text, ttl)
+			if err != nil {
+				app.log.Error("error creating room key", "error", err.Error())
+				dialog.ShowError(err, app.main)
+				return
+			}
+		}
+		value, err := info.Encode()
+		if err != nil {
+			app.log.Error("error encoding room info", "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 		defer cancel()
-		err := app.doPublish(ctx, &v1.PublishRequest{
-			Key: RoomPath(roomName),
-			Ttl: durationpb.New(ttl),
+		err = app.doPublish(ctx, &v1.PublishRequest{
+			Key:   RoomPath(roomName),
+			Value: value,
+			Ttl:   durationpb.New(ttl),
 		})
 		if err != nil {
 			app.log.Error("error creating room", "error", err.Error())
 			dialog.ShowError(err, app.main)
 			return
 		}
-		ourID, _ := app.nodeID.Get()
+		app.forgetRoom(roomName)
+		app.setRoomInfo(roomName, info)
+		if roomKey != nil {
+			app.setRoomKey(roomName, roomKey)
+		}
 		// Add ourself as a member
-		err = app.doPublish(ctx, &v1.PublishRequest{
-			Key: MembersPath(roomName) + "/" + ourID,
-			Ttl: durationpb.New(ttl),
-		})
-		if err != nil {
+		if err := app.joinRoom(ctx, roomName); err != nil {
 			app.log.Error("error adding member", "error", err.Error())
 			dialog.ShowError(err, app.main)
 			return
 		}
-		app.joinRooms = append(app.joinRooms, roomName)
 	}, app.main)
 }
 
@@ -182,60 +305,84 @@ func (app *App) onRoomSelected(index int) {
 	if app.chatContainer.Hidden {
 		return
 	}
-	app.chatGrid.Show()
-	ctx := context.Background()
-	ctx, app.cancelRoomSubscription = context.WithCancel(ctx)
 	roomName, err := app.roomsList.GetItem(index)
 	if err != nil {
 		app.log.Error("error getting room name", "error", err.Error())
 		return
 	}
 	roomNameValue, _ := roomName.(binding.String).Get()
+	app.directListWidget.UnselectAll()
+	if app.rooms.info(roomNameValue) == nil && app.connected.Load() {
+		app.refreshRoomInfo(roomNameValue)
+	}
+	if !app.rooms.locked(roomNameValue) {
+		app.openRoom(roomNameValue)
+		return
+	}
+	app.unlockRoom(roomNameValue, func(ok bool) {
+		if !ok {
+			app.roomsListWidget.UnselectAll()
+			return
+		}
+		app.openRoom(roomNameValue)
+	})
+}
+
+// openRoom shows the transcript of a room and subscribes to it. Messages kept in
+// the chat history are shown straight away, and are all that is shown while we
+// are not connected.
+func (app *App) openRoom(roomNameValue string) {
+	app.chatGrid.Show()
+	ctx := context.Background()
+	ctx, app.cancelRoomSubscription = context.WithCancel(ctx)
 	app.selectedRoom = roomNameValue
+	app.presence = nil
+	// Write a header above the chat view
+	app.chatHeader.SetText(app.roomTitle(roomNameValue))
+	app.updateMuteButton()
+	app.markRoomRead(roomNameValue)
+	app.setChatMembers(nil)
+	transcript := newChatTranscript(roomNameValue)
+	transcript.honor = app.honorRevision
+	app.transcript.Store(transcript)
+	app.chatView.Clear()
+	app.closeThread()
+	app.cancelReply()
+	jump := app.jumpTo
+	app.jumpTo = ""
+	app.loadStoredHistory(transcript, roomNameValue, jump)
+	if !app.connected.Load() {
+		return
+	}
 	c, err := app.dialNode(ctx)
 	if err != nil {
 		app.log.Error("error dialing node", "error", err.Error())
 		return
 	}
-	// Check if we have already joined
-	if !slices.Contains(app.joinRooms, roomNameValue) {
-		// Join the room
-		ourID, _ := app.nodeID.Get()
-		err = app.doPublish(ctx, &v1.PublishRequest{
-			Key: MembersPath(roomNameValue) + "/" + ourID,
-		})
-		if err != nil {
-			app.log.Error("error joining room", "error", err.Error())
-			return
-		}
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+	// Join the room if we have not already
+	if err := app.joinRoom(ctx, roomNameValue); err != nil {
+		app.log.Error("error joining room", "error", err.Error())
+		return
 	}
 	// List the current members
 	cli := v1.NewAppDaemonClient(c)
-	resp, err := cli.Query(ctx, &v1.QueryRequest{
-		Command: v1.QueryRequest_LIST,
-		Query:   MembersPath(roomNameValue),
-	})
+	members, memberKeys, err := app.listMembers(ctx, cli, roomNameValue)
 	if err != nil {
 		app.log.Error("error listing members", "error", err.Error())
 		return
 	}
-	defer resp.CloseSend()
-	result, err := resp.Recv()
-	if err != nil {
-		app.log.Error("error receiving members", "error", err.Error())
-		return
-	}
-	members := make([]string, 0, 10)
-	for _, m := range result.GetValue() {
-		m = strings.TrimPrefix(m, MembersPath(roomNameValue)+"/")
-		parts := strings.Split(m, "/")
-		if len(parts) != 1 {
-			continue
-		}
-		members = append(members, parts[0])
-	}
-	// Write a header to the chat text grid
-	app.chatText.SetText(fmt.Sprintf("Room: %s\nMembers: %s\n", roomNameValue, strings.Join(members, ", ")))
+	app.recordMembers(roomNameValue, members)
+	presence := newRoomPresence()
+	app.presence = presence
+	go app.loadPresence(ctx, cli, roomNameValue, memberKeys, presence)
+	go app.runPresence(ctx, roomNameValue, presence)
+	app.setChatMembers(members)
+	// Subscribe before loading history so nothing published in between is missed.
+	// The transcript drops anything seen both ways.
 	stream, err := cli.Subscribe(ctx, &v1.SubscribeRequest{
 		Prefix: RoomPath(roomNameValue),
 	})
@@ -247,54 +394,276 @@ func (app *App) onRoomSelected(index int) {
 		for {
 			msg, err := stream.Recv()
 			if err != nil {
-				if err == io.EOF {
+				if err == io.EOF || ctx.Err() != nil {
 					return
 				}
 				app.log.Error("error receiving message", "error", err.Error())
+				app.metrics.subscriptionErrors.WithLabelValues("room").Inc()
 				return
 			}
 			prefix := strings.TrimPrefix(msg.GetKey(), RoomPath(roomNameValue)+"/")
 			parts := strings.Split(prefix, "/")
 			switch parts[0] {
 			case "members":
+				if len(parts) == 3 {
+					value, ok := app.openValue(msg.GetKey(), msg.GetValue())
+					if !ok {
+						continue
+					}
+					presence.observe(parts[1], parts[2], value, time.Now())
+					if parts[2] == "typing" {
+						app.updateTypingLabel(presence)
+					} else {
+						app.chatMembersList.Refresh()
+					}
+					continue
+				}
 				if len(parts) != 2 {
 					continue
 				}
-				// Emit a message to the chat text grid
-				app.chatText.SetText(fmt.Sprintf("%sMember %s joined the room\n", app.chatText.Text(), parts[1]))
+				// Membership is refreshed periodically, so only changes are emitted
+				// to the chat transcript.
+				app.recordMember(roomNameValue, parts[1], msg.GetValue())
+				if msg.GetValue() == memberLeft {
+					if !app.removeChatMember(parts[1]) {
+						continue
+					}
+					transcript.insert(&chatEntry{
+						time:   time.Now().UTC(),
+						event:  "left the room",
+						member: parts[1],
+					})
+				} else {
+					if !app.addChatMember(parts[1]) {
+						continue
+					}
+					transcript.insert(&chatEntry{
+						time:   time.Now().UTC(),
+						event:  "joined the room",
+						member: parts[1],
+					})
+				}
 			case "messages":
+				if (len(parts) == 5 || len(parts) == 6) && parts[3] == "reactions" {
+					r, ok := app.parseReaction(msg.GetKey(), msg.GetValue())
+					if !ok || !transcript.react(r) {
+						continue
+					}
+					break
+				}
 				if len(parts) != 3 {
 					continue
 				}
-				// Emit a message to the chat text grid
-				from := parts[2]
-				ts := parts[1]
-				t, _ := time.Parse(time.RFC3339Nano, ts)
-				tstr := t.Format(time.RFC3339)
-				msg := strings.TrimSpace(msg.GetValue())
-				app.chatText.SetText(fmt.Sprintf("%s%s [%s]: %s\n", app.chatText.Text(), from, tstr, msg))
+				// Emit a message to the chat transcript
+				if transcript.insert(app.newMessageEntry(msg.GetKey(), msg.GetValue())) == 0 {
+					continue
+				}
+				presence.clearTyping(parts[2])
+				app.updateTypingLabel(presence)
+				app.metrics.messagesReceived.WithLabelValues(roomNameValue).Inc()
+			default:
+				continue
 			}
+			app.renderTranscript(transcript)
 		}
 	}()
+	// Load the most recent page of messages, or the page around the message being
+	// jumped to, that are not already shown from the chat history.
+	keys, reactions, err := listMessageKeys(ctx, cli, roomNameValue)
+	if err != nil {
+		app.log.Error("error listing room history", "error", err.Error())
+		return
+	}
+	start, end := historyWindow(keys, jump)
+	transcript.setOlder(keys[:start])
+	transcript.insert(app.fetchMessages(ctx, cli, keys[start:end])...)
+	transcript.setNewer(keys[end:])
+	app.renderTranscript(transcript)
+	if jump != "" {
+		app.chatView.ScrollToKey(jump)
+	}
+	if len(reactions) > 0 {
+		go app.loadReactions(ctx, cli, transcript, reactions)
+	}
+}
+
+// historyWindow returns the range of the message keys to load first: the most
+// recent page, or the page around the message being jumped to.
+func historyWindow(keys []string, jump string) (start, end int) {
+	start, end = len(keys)-historyPageSize, len(keys)
+	if i := slices.Index(keys, jump); i >= 0 {
+		start, end = i-historyPageSize/2, i+historyPageSize/2
+		if end > len(keys) {
+			end = len(keys)
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	return start, end
+}
+
+// renderTranscript renders the transcript to the chat view if it belongs to the selected room.
+func (app *App) renderTranscript(transcript *chatTranscript) {
+	if app.transcript.Load() != transcript {
+		return
+	}
+	app.chatView.SetEntries(transcript.snapshot())
+	app.renderThread()
+}
+
+// onChatScrolledToTop pages in older history when the chat is scrolled to the top.
+func (app *App) onChatScrolledToTop() {
+	transcript := app.transcript.Load()
+	if transcript == nil || !transcript.hasOlder() {
+		return
+	}
+	go app.loadOlderHistory(transcript)
+}
+
+// onChatScrolledToBottom pages in newer history when the chat is scrolled to the bottom.
+func (app *App) onChatScrolledToBottom() {
+	transcript := app.transcript.Load()
+	if transcript == nil || !transcript.hasNewer() {
+		return
+	}
+	go app.loadNewerHistory(transcript)
+}
+
+// onChatFollowChanged tells the selected room's transcript whether the chat is
+// scrolled up, so new messages do not push out the ones being read.
+func (app *App) onChatFollowChanged(following bool) {
+	if transcript := app.transcript.Load(); transcript != nil {
+		transcript.setScrolledUp(!following)
+	}
+}
+
+// chatEntryMenu returns the context menu for an entry in the chat view.
+func (app *App) chatEntryMenu(entry *chatEntry) *fyne.Menu {
+	if entry.message == nil {
+		return nil
+	}
+	msg := entry.message
+	menu := fyne.NewMenu("",
+		fyne.NewMenuItem("Copy Text", func() {
+			app.main.Clipboard().SetContent(entry.current().displayText())
+		}),
+		fyne.NewMenuItem("Copy Sender ID", func() {
+			app.main.Clipboard().SetContent(msg.From)
+		}),
+	)
+	if !entry.deleted() {
+		menu.Items = append(menu.Items, fyne.NewMenuItem("Reply", func() {
+			app.onReply(entry)
+		}))
+		react := fyne.NewMenuItem("React", nil)
+		react.ChildMenu = app.reactionMenu(entry)
+		menu.Items = append(menu.Items, react)
+	}
+	if entry.replies > 0 || msg.Reply != nil {
+		menu.Items = append(menu.Items, fyne.NewMenuItem("View Thread", func() {
+			app.openThread(entry)
+		}))
+	}
+	if entry.current().ContentType == ContentTypeMarkdown && !entry.deleted() {
+		if plain := app.chatView.IsPlain(msg.ID); plain {
+			menu.Items = append(menu.Items, fyne.NewMenuItem("Show Formatted", func() {
+				app.setPlain(msg.ID, false)
+			}))
+		} else {
+			menu.Items = append(menu.Items, fyne.NewMenuItem("Show Plain Text", func() {
+				app.setPlain(msg.ID, true)
+			}))
+		}
+	}
+	if app.canEdit(entry) {
+		menu.Items = append(menu.Items, fyne.NewMenuItem("Edit…", func() {
+			app.onEditMessage(entry)
+		}))
+	}
+	if app.canDelete(entry) {
+		menu.Items = append(menu.Items, fyne.NewMenuItem("Delete", func() {
+			app.onDeleteMessage(entry)
+		}))
+	}
+	if entry.current().attachmentManifest() != nil {
+		menu.Items = append(menu.Items, fyne.NewMenuItem("Save Attachment…", func() {
+			app.onSaveAttachment(entry)
+		}))
+	}
+	if ourID, _ := app.nodeID.Get(); msg.From != ourID {
+		menu.Items = append(menu.Items, fyne.NewMenuItem("Send Direct Message", func() {
+			go app.startDirectMessage(msg.From)
+		}))
+	}
+	if app.verifyMessage(entry) == verifyKeyChanged {
+		menu.Items = append(menu.Items, fyne.NewMenuItem("Trust New Sender Key", func() {
+			dialog.ShowConfirm("Trust New Sender Key",
+				fmt.Sprintf("%s has published a different signing key. Only trust it if you know they reinstalled the app.", msg.From),
+				func(ok bool) {
+					if !ok {
+						return
+					}
+					if err := app.trustPublishedKey(msg.From); err != nil {
+						dialog.ShowError(err, app.main)
+					}
+				}, app.main)
+		}))
+	}
+	return menu
 }
 
 func (app *App) onSendMessage(s string) {
 	if s == "" {
 		return
 	}
+	app.markActive()
 	nodeID, _ := app.nodeID.Get()
-	key := NewMessageKey(app.selectedRoom, nodeID)
+	msg, err := NewChatMessage(nodeID, app.messageContentType(), s)
+	if err != nil {
+		app.log.Error("error creating message", "error", err.Error())
+		return
+	}
+	if app.replyingTo != nil {
+		msg.Reply = newReply(app.replyingTo)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	err := app.doPublish(ctx, &v1.PublishRequest{
-		Key:   key,
-		Value: s,
-	})
-	if err != nil {
+	if err := app.sendMessage(ctx, app.selectedRoom, msg); err != nil {
 		app.log.Error("error sending message", "error", err.Error())
+		if errors.Is(err, errRoomLocked) {
+			dialog.ShowError(err, app.main)
+		}
 		return
 	}
 	app.chatInput.SetText("")
+	app.cancelReply()
+}
+
+// sendMessage signs a message, seals it if the room is encrypted and publishes it to the room.
+func (app *App) sendMessage(ctx context.Context, roomName string, msg *ChatMessage) error {
+	key := NewMessageKey(roomName, msg.From)
+	signingKey, err := app.signingKey()
+	if err != nil {
+		return err
+	}
+	value, err := msg.EncodeSigned(signingKey, key)
+	if err != nil {
+		return err
+	}
+	value, err = app.sealMessage(roomName, key, value)
+	if err != nil {
+		return err
+	}
+	err = app.doPublish(ctx, &v1.PublishRequest{
+		Key:   key,
+		Value: value,
+	})
+	if err != nil {
+		return err
+	}
+	app.metrics.messagesSent.WithLabelValues(roomName).Inc()
+	return nil
 }
 
 func (app *App) onRoomUnselected(index int) {
@@ -303,7 +672,14 @@ func (app *App) onRoomUnselected(index int) {
 	}
 	app.chatGrid.Hide()
 	app.cancelRoomSubscription()
-	app.chatText.SetText("")
+	app.transcript.Store(nil)
+	app.presence = nil
+	app.typingLabel.SetText("")
+	app.chatHeader.SetText("")
+	app.chatMembers.Set([]string{})
+	app.chatView.Clear()
+	app.closeThread()
+	app.cancelReply()
 }
 
 var validPSKChars = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -0,0 +1,138 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "github.com/webmeshproj/api/v1"
+)
+
+// historyPageSize is the number of stored messages loaded at a time.
+const historyPageSize = 50
+
+// listMessageKeys returns the keys of the messages stored in a room, oldest first,
+// and the keys of the reactions to them.
+func listMessageKeys(ctx context.Context, cli v1.AppDaemonClient, roomName string) (messages, reactions []string, err error) {
+	keys, err := queryKeys(ctx, cli, MessagesPath(roomName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	prefix := MessagesPath(roomName) + "/"
+	messages = make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+		switch {
+		case len(parts) == 2:
+			messages = append(messages, key)
+		case (len(parts) == 4 || len(parts) == 5) && parts[2] == "reactions":
+			reactions = append(reactions, key)
+		}
+	}
+	sortMessageKeys(messages)
+	return messages, reactions, nil
+}
+
+// fetchMessages returns transcript entries for the messages stored at the given keys.
+// Messages kept in the chat history are read from it, and the rest are fetched from
+// the node unless cli is nil. Messages that cannot be fetched are logged and skipped.
+func (app *App) fetchMessages(ctx context.Context, cli v1.AppDaemonClient, keys []string) []*chatEntry {
+	entries := make([]*chatEntry, 0, len(keys))
+	for _, key := range keys {
+		value, ok := app.storedMessage(key)
+		if !ok {
+			if cli == nil {
+				continue
+			}
+			var err error
+			value, err = queryValue(ctx, cli, key)
+			if err != nil {
+				app.log.Error("error fetching message", "key", key, "error", err.Error())
+				continue
+			}
+			app.recordMessage(key, value)
+		}
+		entry := app.newMessageEntry(key, value)
+		app.search.add(key, entry.message)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// newMessageEntry returns a transcript entry for the message published at the given key.
+func (app *App) newMessageEntry(key, value string) *chatEntry {
+	msg := app.openMessage(key, value)
+	_, t := parseMessageKey(key)
+	if t.IsZero() {
+		t = msg.SentAt
+	}
+	return &chatEntry{key: key, time: t, message: msg}
+}
+
+// loadOlderHistory pages in the next set of older stored messages for the transcript.
+func (app *App) loadOlderHistory(transcript *chatTranscript) {
+	app.loadHistoryPage(transcript, true)
+}
+
+// loadNewerHistory pages in the next set of newer stored messages for the transcript.
+func (app *App) loadNewerHistory(transcript *chatTranscript) {
+	app.loadHistoryPage(transcript, false)
+}
+
+// loadHistoryPage loads a page of stored messages on one side of the transcript's window.
+func (app *App) loadHistoryPage(transcript *chatTranscript, older bool) {
+	if !app.loadingHistory.CompareAndSwap(false, true) {
+		return
+	}
+	defer app.loadingHistory.Store(false)
+	var keys []string
+	if older {
+		keys = transcript.takeOlder(historyPageSize)
+	} else {
+		keys = transcript.takeNewer(historyPageSize)
+	}
+	if len(keys) == 0 {
+		if !older && transcript.hasNewer() {
+			// Only events are queued.
+			transcript.insertNewer()
+			app.renderTranscript(transcript)
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	var cli v1.AppDaemonClient
+	if app.connected.Load() && !app.hasStoredMessages(keys) {
+		c, err := app.dialNode(ctx)
+		if err != nil {
+			app.log.Error("error dialing node", "error", err.Error())
+			return
+		}
+		defer c.Close()
+		cli = v1.NewAppDaemonClient(c)
+	}
+	entries := app.fetchMessages(ctx, cli, keys)
+	if older {
+		transcript.insertOlder(entries...)
+	} else {
+		transcript.insertNewer(entries...)
+	}
+	app.renderTranscript(transcript)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/widget"
+)
+
+// chatInputEntry is a multi-line entry for composing messages. Enter sends the
+// message and Shift+Enter starts a new line, so pasted code keeps its lines.
+type chatInputEntry struct {
+	widget.Entry
+	shift bool
+}
+
+func newChatInputEntry() *chatInputEntry {
+	e := &chatInputEntry{}
+	e.MultiLine = true
+	e.Wrapping = fyne.TextWrapWord
+	e.ExtendBaseWidget(e)
+	e.SetMinRowsVisible(2)
+	return e
+}
+
+func (e *chatInputEntry) KeyDown(key *fyne.KeyEvent) {
+	if key.Name == desktop.KeyShiftLeft || key.Name == desktop.KeyShiftRight {
+		e.shift = true
+	}
+	e.Entry.KeyDown(key)
+}
+
+func (e *chatInputEntry) KeyUp(key *fyne.KeyEvent) {
+	if key.Name == desktop.KeyShiftLeft || key.Name == desktop.KeyShiftRight {
+		e.shift = false
+	}
+	e.Entry.KeyUp(key)
+}
+
+func (e *chatInputEntry) TypedKey(key *fyne.KeyEvent) {
+	if key.Name != fyne.KeyReturn && key.Name != fyne.KeyEnter {
+		e.Entry.TypedKey(key)
+		return
+	}
+	if !e.shift {
+		if e.OnSubmitted != nil {
+			e.OnSubmitted(e.Text)
+		}
+		return
+	}
+	// The entry submits on Shift+Enter when it has a submit handler, so hide it
+	// to insert the new line.
+	submitted := e.OnSubmitted
+	e.OnSubmitted = nil
+	e.Entry.TypedKey(key)
+	e.OnSubmitted = submitted
+}
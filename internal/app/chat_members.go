@@ -0,0 +1,245 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// memberListWidth is the width of the room member list.
+const memberListWidth = 180
+
+// newChatMembersPanel returns the panel listing the members of the selected room.
+func (app *App) newChatMembersPanel() fyne.CanvasObject {
+	app.chatMembersList = widget.NewListWithData(app.chatMembers,
+		func() fyne.CanvasObject {
+			item := newMemberItem(app.profiles)
+			item.menu = app.memberMenu
+			item.presence = app.memberPresence
+			return item
+		},
+		func(item binding.DataItem, obj fyne.CanvasObject) {
+			id, _ := item.(binding.String).Get()
+			obj.(*memberItem).setNodeID(id)
+		},
+	)
+	title := widget.NewLabel("Members")
+	separator := widget.NewSeparator()
+	return container.New(layout.NewBorderLayout(title, nil, separator, nil),
+		title, separator, app.chatMembersList)
+}
+
+// setChatMembers sets the members of the selected room.
+func (app *App) setChatMembers(nodeIDs []string) {
+	changed := app.profiles.setMembers(nodeIDs)
+	app.profiles.sortByName(nodeIDs)
+	app.chatMembers.Set(nodeIDs)
+	if changed {
+		// Names impersonating a member are flagged.
+		app.chatView.Invalidate()
+	}
+}
+
+// addChatMember adds a node to the members of the selected room and returns true
+// if it was not already listed.
+func (app *App) addChatMember(nodeID string) bool {
+	members, _ := app.chatMembers.Get()
+	if slices.Contains(members, nodeID) {
+		return false
+	}
+	app.setChatMembers(append(slices.Clone(members), nodeID))
+	return true
+}
+
+// removeChatMember removes a node from the members of the selected room and returns
+// true if it was listed.
+func (app *App) removeChatMember(nodeID string) bool {
+	members, _ := app.chatMembers.Get()
+	i := slices.Index(members, nodeID)
+	if i < 0 {
+		return false
+	}
+	app.setChatMembers(slices.Delete(slices.Clone(members), i, i+1))
+	return true
+}
+
+// onProfilesChanged updates everything showing node names after a profile changes.
+func (app *App) onProfilesChanged() {
+	app.verified.clear()
+	members, _ := app.chatMembers.Get()
+	app.setChatMembers(slices.Clone(members))
+	app.chatMembersList.Refresh()
+	app.chatView.Invalidate()
+}
+
+// memberMenu returns the context menu for a room member.
+func (app *App) memberMenu(nodeID string) *fyne.Menu {
+	menu := fyne.NewMenu("",
+		fyne.NewMenuItem("Copy Node ID", func() {
+			app.main.Clipboard().SetContent(nodeID)
+		}),
+	)
+	if ourID, _ := app.nodeID.Get(); nodeID != ourID {
+		menu.Items = append(menu.Items, fyne.NewMenuItem("Send Direct Message", func() {
+			go app.startDirectMessage(nodeID)
+		}))
+	}
+	return menu
+}
+
+// memberPresence returns the presence of a member of the selected room.
+func (app *App) memberPresence(nodeID string) string {
+	presence := app.presence
+	if presence == nil {
+		return presenceOffline
+	}
+	return presence.state(nodeID, time.Now())
+}
+
+// memberItem shows a room member's avatar, name and status. The node ID is shown
+// in place of the status while hovered.
+type memberItem struct {
+	widget.BaseWidget
+
+	profiles *profileDirectory
+	nodeID   string
+	hovered  bool
+	// menu returns the context menu for a member.
+	menu func(nodeID string) *fyne.Menu
+	// presence returns the presence of a member.
+	presence func(nodeID string) string
+
+	avatar *canvas.Circle
+	dot    *canvas.Circle
+	name   *canvas.Text
+	detail *canvas.Text
+}
+
+func newMemberItem(profiles *profileDirectory) *memberItem {
+	m := &memberItem{
+		profiles: profiles,
+		avatar:   canvas.NewCircle(theme.PrimaryColor()),
+		dot:      canvas.NewCircle(theme.DisabledColor()),
+		name:     canvas.NewText("", theme.ForegroundColor()),
+		detail:   canvas.NewText("", theme.PlaceHolderColor()),
+	}
+	m.detail.TextSize = theme.CaptionTextSize()
+	m.ExtendBaseWidget(m)
+	return m
+}
+
+func (m *memberItem) setNodeID(nodeID string) {
+	m.nodeID = nodeID
+	m.Refresh()
+}
+
+// MouseIn shows the member's node ID.
+func (m *memberItem) MouseIn(*desktop.MouseEvent) {
+	m.hovered = true
+	m.Refresh()
+}
+
+func (m *memberItem) MouseMoved(*desktop.MouseEvent) {}
+
+// MouseOut restores the member's status.
+func (m *memberItem) MouseOut() {
+	m.hovered = false
+	m.Refresh()
+}
+
+// TappedSecondary shows the context menu for the member.
+func (m *memberItem) TappedSecondary(ev *fyne.PointEvent) {
+	if m.nodeID == "" || m.menu == nil {
+		return
+	}
+	c := fyne.CurrentApp().Driver().CanvasForObject(m)
+	if c == nil {
+		return
+	}
+	widget.ShowPopUpMenuAtPosition(m.menu(m.nodeID), c, ev.AbsolutePosition)
+}
+
+func (m *memberItem) CreateRenderer() fyne.WidgetRenderer {
+	return &memberItemRenderer{item: m}
+}
+
+type memberItemRenderer struct {
+	item *memberItem
+}
+
+func (r *memberItemRenderer) Layout(size fyne.Size) {
+	m, pad := r.item, theme.Padding()
+	lineHeight := chatLineHeight()
+	m.avatar.Move(fyne.NewPos(pad, (size.Height-lineHeight)/2+pad/2))
+	m.avatar.Resize(fyne.NewSize(lineHeight-pad, lineHeight-pad))
+	dotSize := (lineHeight - pad) / 3
+	m.dot.Move(m.avatar.Position().Add(fyne.NewPos(lineHeight-pad-dotSize, lineHeight-pad-dotSize)))
+	m.dot.Resize(fyne.NewSize(dotSize, dotSize))
+	x := pad*2 + lineHeight - pad
+	m.name.Move(fyne.NewPos(x, pad))
+	m.name.Resize(m.name.MinSize())
+	m.detail.Move(fyne.NewPos(x, pad+lineHeight))
+	m.detail.Resize(m.detail.MinSize())
+}
+
+func (r *memberItemRenderer) MinSize() fyne.Size {
+	return fyne.NewSize(memberListWidth, theme.Padding()*2+chatLineHeight()+r.item.detail.MinSize().Height)
+}
+
+func (r *memberItemRenderer) Refresh() {
+	m := r.item
+	name, flagged := m.profiles.name(m.nodeID)
+	m.name.Text = truncate(name, 24)
+	m.name.Color = theme.ForegroundColor()
+	if flagged {
+		m.name.Color = theme.WarningColor()
+	}
+	m.avatar.FillColor = m.profiles.color(m.nodeID)
+	state := presenceOffline
+	if m.presence != nil {
+		state = m.presence(m.nodeID)
+	}
+	m.dot.FillColor = presenceColor(state)
+	m.dot.StrokeColor = theme.BackgroundColor()
+	m.dot.StrokeWidth = 1
+	if state == presenceOffline && !flagged {
+		m.name.Color = theme.PlaceHolderColor()
+	}
+	m.detail.Text = truncate(m.profiles.status(m.nodeID), 32)
+	if m.hovered || m.detail.Text == "" {
+		m.detail.Text = truncate(m.nodeID, 32)
+	}
+	m.detail.Color = theme.PlaceHolderColor()
+	r.Layout(m.Size())
+	canvas.Refresh(m)
+}
+
+func (r *memberItemRenderer) Objects() []fyne.CanvasObject {
+	return []fyne.CanvasObject{r.item.avatar, r.item.dot, r.item.name, r.item.detail}
+}
+
+func (r *memberItemRenderer) Destroy() {}
@@ -0,0 +1,162 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// ChatMessageVersion is the current version of the chat message envelope.
+	ChatMessageVersion = 1
+	// ContentTypeText is the content type for plain text messages.
+	ContentTypeText = "text/plain"
+	// ContentTypeTombstone is the content type of a revision that deletes a message.
+	ContentTypeTombstone = "application/vnd.webmesh.tombstone"
+)
+
+// ChatMessage is the envelope published as the value of a room message key.
+type ChatMessage struct {
+	// Version is the version of the envelope. Values without a version
+	// are legacy plain text messages.
+	Version int `json:"v"`
+	// ID is the unique ID of the message.
+	ID string `json:"id"`
+	// From is the ID of the node that sent the message.
+	From string `json:"from"`
+	// SentAt is the time the message was sent.
+	SentAt time.Time `json:"sentAt"`
+	// ContentType is the MIME type of the body.
+	ContentType string `json:"contentType"`
+	// Body is the content of the message.
+	Body string `json:"body"`
+	// Metadata is optional extra information about the message.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Reply is set if the message is a reply in a thread.
+	Reply *ChatReply `json:"reply,omitempty"`
+	// Replaces is the ID of the message this message is a revision of. Revisions
+	// are only honored from the sender of the original message.
+	Replaces string `json:"replaces,omitempty"`
+	// Signature is the sender's Ed25519 signature over the message and its key. It
+	// is published in the signed envelope around the message.
+	Signature []byte `json:"-"`
+	// signed is the encoded message the signature covers.
+	signed []byte
+}
+
+// ChatReply references the thread a reply belongs to and quotes the message replied to.
+type ChatReply struct {
+	// ID is the ID of the message that started the thread.
+	ID string `json:"id"`
+	// From is the ID of the node that sent the quoted message.
+	From string `json:"from"`
+	// Excerpt is the start of the quoted message.
+	Excerpt string `json:"excerpt,omitempty"`
+}
+
+// NewChatMessage returns a new message from the given node with a random ID.
+func NewChatMessage(from, contentType, body string) (*ChatMessage, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return &ChatMessage{
+		Version:     ChatMessageVersion,
+		ID:          hex.EncodeToString(id),
+		From:        from,
+		SentAt:      time.Now().UTC(),
+		ContentType: contentType,
+		Body:        body,
+	}, nil
+}
+
+// Encode returns the message encoded for publishing.
+func (m *ChatMessage) Encode() (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode message: %w", err)
+	}
+	return string(data), nil
+}
+
+// DecodeChatMessage decodes a message published under the given key. Values that
+// are not a versioned envelope are treated as legacy plain text, with the sender
+// and time taken from the key.
+func DecodeChatMessage(key, value string) *ChatMessage {
+	var env signedMessage
+	if strings.HasPrefix(strings.TrimSpace(value), "{") && json.Unmarshal([]byte(value), &env) == nil && len(env.Message) > 0 {
+		msg := DecodeChatMessage(key, string(env.Message))
+		msg.Signature = env.Signature
+		msg.signed = env.Message
+		return msg
+	}
+	from, sentAt := parseMessageKey(key)
+	var msg ChatMessage
+	if strings.HasPrefix(strings.TrimSpace(value), "{") && json.Unmarshal([]byte(value), &msg) == nil && msg.Version > 0 {
+		if msg.From == "" {
+			msg.From = from
+		}
+		if msg.SentAt.IsZero() {
+			msg.SentAt = sentAt
+		}
+		if msg.ContentType == "" {
+			msg.ContentType = ContentTypeText
+		}
+		return &msg
+	}
+	return &ChatMessage{
+		ID:          key,
+		From:        from,
+		SentAt:      sentAt,
+		ContentType: ContentTypeText,
+		Body:        strings.TrimSpace(value),
+	}
+}
+
+// parseMessageKey returns the sender and timestamp from a message key.
+func parseMessageKey(key string) (from string, sentAt time.Time) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 2 {
+		return "", time.Time{}
+	}
+	sentAt, _ = time.Parse(time.RFC3339Nano, parts[len(parts)-2])
+	return parts[len(parts)-1], sentAt
+}
+
+// displayText returns the text to display for the message body.
+func (m *ChatMessage) displayText() string {
+	switch {
+	case strings.HasPrefix(m.ContentType, "text/"):
+		return strings.TrimSpace(m.Body)
+	case m.ContentType == ContentTypeTombstone:
+		return "[message deleted]"
+	case m.ContentType == ContentTypeLocked:
+		return "[encrypted message]"
+	case m.ContentType == ContentTypeAttachment:
+		if a := m.attachmentManifest(); a != nil {
+			return fmt.Sprintf("Attachment: %s (%s)", a.Name, bytesString(int(a.Size)))
+		}
+		return "[invalid attachment]"
+	default:
+		return fmt.Sprintf("[unsupported content type %q]", m.ContentType)
+	}
+}
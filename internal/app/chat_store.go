@@ -0,0 +1,850 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// chatStoreFile is the name of the chat history file in the app storage directory.
+	chatStoreFile = "chat-history.dat"
+	// chatStoreRekeySuffix is appended to the chat history file name for the history
+	// written under a new key, until the key is saved.
+	chatStoreRekeySuffix = ".rekey"
+	// chatStoreCorruptSuffix is appended to the chat history file name to keep a
+	// history that could not be read in full.
+	chatStoreCorruptSuffix = ".corrupt"
+	// chatStoreAD is the additional data every chat history record is sealed with.
+	chatStoreAD = "webmesh chat history"
+	// chatStoreMaxRecord is the largest record accepted when reading the history file.
+	chatStoreMaxRecord = 16 << 20
+	// minChatHistoryPassphrase is the shortest passphrase accepted for the chat history.
+	minChatHistoryPassphrase = 8
+
+	// preferenceChatHistory is the preference for keeping chat history on this device.
+	preferenceChatHistory = "chatHistory"
+	// preferenceChatHistoryKey is the preference holding the key generated for this
+	// install, used when the history is not protected by a passphrase. It is kept with
+	// the other preferences, so it only protects the history file on its own.
+	preferenceChatHistoryKey = "chatHistoryKey"
+	// preferenceChatHistorySalt is the preference holding the salt of the passphrase
+	// protecting the history. It is only set when a passphrase is used.
+	preferenceChatHistorySalt = "chatHistorySalt"
+	// preferenceLastNodeID is the preference holding the node ID we last connected
+	// as, used to read direct messages offline.
+	preferenceLastNodeID = "lastNodeID"
+)
+
+// errChatStoreKey is returned when the chat history cannot be decrypted.
+var errChatStoreKey = errors.New("incorrect chat history passphrase")
+
+// errChatRecordAuth is returned when a chat history record fails authentication,
+// either because it is corrupt or because it was sealed with another key.
+var errChatRecordAuth = errors.New("chat history record failed authentication")
+
+// chatRecord is a single record in the chat history file.
+type chatRecord struct {
+	// Kind is one of room, message, member or profile.
+	Kind string `json:"k"`
+	// Room is the room the record belongs to, for members.
+	Room string `json:"r,omitempty"`
+	// Key is the room name, message key, member node ID or profile node ID.
+	Key string `json:"key"`
+	// Value is the value as published. Messages are kept sealed if the room is encrypted.
+	Value string `json:"v"`
+}
+
+// chatStore is an append-only, encrypted on-disk log of the rooms, messages,
+// memberships and profiles the app has seen. It is read into memory when opened.
+type chatStore struct {
+	mu   sync.Mutex
+	path string
+	aead cipher.AEAD
+	// records is the number of records in the file, for deciding when to compact it.
+	records int
+	// skipped is the number of corrupt records skipped when the file was opened.
+	skipped int
+	// readOnly is set when a rekeyed history could not replace the file. The file is
+	// still under the old key, so nothing is appended until the history is opened
+	// again and the swap is finished.
+	readOnly bool
+	rooms    map[string]string
+	messages map[string]map[string]string
+	members  map[string]map[string]string
+	profiles map[string]string
+}
+
+// openChatStore opens the chat history in the given directory with the given key,
+// creating it if needed.
+func openChatStore(dir string, key []byte) (*chatStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create storage directory: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	s := &chatStore{path: filepath.Join(dir, chatStoreFile), aead: aead}
+	s.reset()
+	if err := s.finishRekey(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read chat history: %w", err)
+	}
+	var good, opened int
+	var badLength, firstAuth bool
+	for len(data) >= 4 {
+		n := int(binary.LittleEndian.Uint32(data))
+		if n > chatStoreMaxRecord {
+			badLength = true
+			break
+		}
+		if len(data) < 4+n {
+			break
+		}
+		rec, err := s.open(data[4 : 4+n])
+		s.records++
+		good += 4 + n
+		data = data[4+n:]
+		if err != nil {
+			// Skip a corrupt record, it is dropped when the history is compacted.
+			if s.records == 1 {
+				firstAuth = errors.Is(err, errChatRecordAuth)
+			}
+			s.skipped++
+			continue
+		}
+		s.apply(rec)
+		opened++
+	}
+	// Nothing opening is only taken as the wrong key if the first record does not
+	// authenticate. Otherwise the key is right and the records are corrupt.
+	if opened == 0 && firstAuth {
+		return nil, errChatStoreKey
+	}
+	switch {
+	case badLength, opened == 0 && s.skipped > 0:
+		// The records after a corrupt length cannot be found, and a history with no
+		// readable records is of no use, so the file is kept aside and the history is
+		// written again from the records read.
+		if badLength {
+			s.skipped++
+		}
+		if err := os.Rename(s.path, s.path+chatStoreCorruptSuffix); err != nil {
+			return nil, fmt.Errorf("keep corrupt chat history: %w", err)
+		}
+		if err := s.rewrite(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case len(data) > 0:
+		// Drop a partial record left by an interrupted write so appends stay aligned.
+		if err := os.Truncate(s.path, int64(good)); err != nil {
+			return nil, fmt.Errorf("truncate chat history: %w", err)
+		}
+	}
+	if s.records > 2*s.live()+1000 {
+		if err := s.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// reset empties the in-memory state. The caller must hold the lock.
+func (s *chatStore) reset() {
+	s.records = 0
+	s.rooms = make(map[string]string)
+	s.messages = make(map[string]map[string]string)
+	s.members = make(map[string]map[string]string)
+	s.profiles = make(map[string]string)
+}
+
+// live returns the number of records needed to write the current state. The caller
+// must hold the lock.
+func (s *chatStore) live() int {
+	n := len(s.rooms) + len(s.profiles)
+	for _, m := range s.messages {
+		n += len(m)
+	}
+	for _, m := range s.members {
+		n += len(m)
+	}
+	return n
+}
+
+// apply applies a record to the in-memory state and returns false if it changes
+// nothing. The caller must hold the lock.
+func (s *chatStore) apply(rec *chatRecord) bool {
+	var m map[string]string
+	switch rec.Kind {
+	case "room":
+		m = s.rooms
+	case "profile":
+		m = s.profiles
+	case "message":
+		room := roomFromKey(rec.Key)
+		if s.messages[room] == nil {
+			s.messages[room] = make(map[string]string)
+		}
+		m = s.messages[room]
+	case "member":
+		if s.members[rec.Room] == nil {
+			s.members[rec.Room] = make(map[string]string)
+		}
+		m = s.members[rec.Room]
+	default:
+		return false
+	}
+	if old, ok := m[rec.Key]; ok && old == rec.Value {
+		return false
+	}
+	m[rec.Key] = rec.Value
+	return true
+}
+
+// put records a change, appending it to the file if it changes anything.
+func (s *chatStore) put(rec *chatRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.apply(rec) || s.readOnly {
+		return nil
+	}
+	data, err := s.seal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open chat history: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("write chat history: %w", err)
+	}
+	s.records++
+	return nil
+}
+
+// seal encrypts a record and frames it with its length.
+func (s *chatStore) seal(rec *chatRecord) ([]byte, error) {
+	plaintext, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode chat history record: %w", err)
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(chatStoreAD))
+	out := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(sealed)), uint32(len(sealed)))
+	return append(out, sealed...), nil
+}
+
+// open decrypts a record.
+func (s *chatStore) open(sealed []byte) (*chatRecord, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("chat history record is too short")
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():], []byte(chatStoreAD))
+	if err != nil {
+		return nil, errChatRecordAuth
+	}
+	var rec chatRecord
+	if err := json.Unmarshal(plaintext, &rec); err != nil {
+		return nil, fmt.Errorf("failed to decode chat history record: %w", err)
+	}
+	return &rec, nil
+}
+
+// rewrite writes the current state to a new file and replaces the old one. The
+// caller must hold the lock.
+func (s *chatStore) rewrite() error {
+	tmp := s.path + ".tmp"
+	n, err := s.writeFile(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write chat history: %w", err)
+	}
+	s.records = n
+	return nil
+}
+
+// writeFile writes the current state to a file and returns the number of records
+// written. The caller must hold the lock.
+func (s *chatStore) writeFile(path string) (int, error) {
+	var recs []*chatRecord
+	for name, v := range s.rooms {
+		recs = append(recs, &chatRecord{Kind: "room", Key: name, Value: v})
+	}
+	for id, v := range s.profiles {
+		recs = append(recs, &chatRecord{Kind: "profile", Key: id, Value: v})
+	}
+	for room, m := range s.members {
+		for id, v := range m {
+			recs = append(recs, &chatRecord{Kind: "member", Room: room, Key: id, Value: v})
+		}
+	}
+	for _, m := range s.messages {
+		for key, v := range m {
+			recs = append(recs, &chatRecord{Kind: "message", Key: key, Value: v})
+		}
+	}
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		data, err := s.seal(rec)
+		if err != nil {
+			return 0, err
+		}
+		buf.Write(data)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return 0, fmt.Errorf("write chat history: %w", err)
+	}
+	return len(recs), nil
+}
+
+// rekey encrypts the history with a new key. The history is first written under the
+// new key to a separate file, which only replaces the history once save has stored
+// what is needed to derive the new key. If that is interrupted, finishRekey completes
+// or discards the swap the next time the history is opened.
+func (s *chatStore) rekey(key []byte, save func()) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return fmt.Errorf("failed to create cipher: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.aead
+	s.aead = aead
+	tmp := s.path + chatStoreRekeySuffix
+	n, err := s.writeFile(tmp)
+	if err != nil {
+		s.aead = old
+		os.Remove(tmp)
+		return err
+	}
+	save()
+	if err := os.Rename(tmp, s.path); err != nil {
+		s.readOnly = true
+		return fmt.Errorf("write chat history: %w", err)
+	}
+	s.readOnly = false
+	s.records = n
+	return nil
+}
+
+// finishRekey replaces the history with the file written by an interrupted rekey if
+// it opens with the store's key, meaning the new key was saved, and removes it
+// otherwise.
+func (s *chatStore) finishRekey() error {
+	tmp := s.path + chatStoreRekeySuffix
+	data, err := os.ReadFile(tmp)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read chat history: %w", err)
+	}
+	if len(data) >= 4 {
+		n := int(binary.LittleEndian.Uint32(data))
+		if n <= chatStoreMaxRecord && len(data) >= 4+n {
+			if _, err := s.open(data[4 : 4+n]); err == nil {
+				if err := os.Rename(tmp, s.path); err != nil {
+					return fmt.Errorf("write chat history: %w", err)
+				}
+				return nil
+			}
+		}
+	}
+	if err := os.Remove(tmp); err != nil {
+		return fmt.Errorf("remove chat history: %w", err)
+	}
+	return nil
+}
+
+// clear deletes the history.
+func (s *chatStore) clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	for _, path := range []string{s.path, s.path + chatStoreRekeySuffix} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("delete chat history: %w", err)
+		}
+	}
+	s.readOnly = false
+	return nil
+}
+
+// roomInfos returns the stored info of each room.
+func (s *chatStore) roomInfos() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string, len(s.rooms))
+	for name, v := range s.rooms {
+		out[name] = v
+	}
+	return out
+}
+
+// profileValues returns the stored profile of each node.
+func (s *chatStore) profileValues() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string, len(s.profiles))
+	for id, v := range s.profiles {
+		out[id] = v
+	}
+	return out
+}
+
+// message returns the stored value of a message.
+func (s *chatStore) message(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.messages[roomFromKey(key)][key]
+	return v, ok
+}
+
+// messageKeys returns the keys of the stored messages of a room, oldest first.
+func (s *chatStore) messageKeys(roomName string) []string {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.messages[roomName]))
+	for key := range s.messages[roomName] {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+	sortMessageKeys(keys)
+	return keys
+}
+
+// memberIDs returns the nodes last seen as members of a room.
+func (s *chatStore) memberIDs(roomName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for id, v := range s.members[roomName] {
+		if v != memberLeft {
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// chatStoreInstallKey returns the key generated for this install, generating it if needed.
+func (app *App) chatStoreInstallKey() ([]byte, error) {
+	if key, err := base64.StdEncoding.DecodeString(app.Preferences().String(preferenceChatHistoryKey)); err == nil && len(key) == chacha20poly1305.KeySize {
+		return key, nil
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	app.Preferences().SetString(preferenceChatHistoryKey, base64.StdEncoding.EncodeToString(key))
+	return key, nil
+}
+
+// openChatHistory opens the chat history in the app storage directory if it is
+// enabled. A passphrase is asked for if it is protected by one, and offered first if
+// there is no history yet.
+func (app *App) openChatHistory() {
+	if !app.Preferences().BoolWithFallback(preferenceChatHistory, true) || app.chatHistory.Load() != nil {
+		return
+	}
+	if salt, err := base64.StdEncoding.DecodeString(app.Preferences().String(preferenceChatHistorySalt)); err == nil && len(salt) > 0 {
+		app.unlockChatHistory(salt)
+		return
+	}
+	if app.Preferences().String(preferenceChatHistoryKey) == "" {
+		app.setupChatHistory()
+		return
+	}
+	key, err := app.chatStoreInstallKey()
+	if err != nil {
+		app.log.Error("error opening chat history", "error", err.Error())
+		return
+	}
+	if err := app.onChatHistoryKey(key); errors.Is(err, errChatStoreKey) {
+		// The key of this install cannot be entered again, so a history it does not
+		// open is kept aside and a new one is started.
+		path := filepath.Join(app.Storage().RootURI().Path(), chatStoreFile)
+		if err := os.Rename(path, path+chatStoreCorruptSuffix); err != nil {
+			app.log.Error("error keeping unreadable chat history", "error", err.Error())
+			return
+		}
+		app.log.Warn("chat history does not open with this install's key, starting a new one")
+		app.onChatHistoryKey(key)
+	}
+}
+
+// setupChatHistory asks for a passphrase to protect a new chat history. Skipping it
+// keeps the history with a key generated for this install.
+func (app *App) setupChatHistory() {
+	passphrase := widget.NewPasswordEntry()
+	passphrase.Validator = func(s string) error {
+		if len([]rune(s)) < minChatHistoryPassphrase {
+			return fmt.Errorf("passphrase must be at least %d characters", minChatHistoryPassphrase)
+		}
+		return nil
+	}
+	confirm := widget.NewPasswordEntry()
+	confirm.Validator = func(s string) error {
+		if s != passphrase.Text {
+			return errors.New("passphrases do not match")
+		}
+		return nil
+	}
+	item := widget.NewFormItem("Passphrase", passphrase)
+	item.HintText = "Without a passphrase, the key is kept in the app preferences"
+	dialog.ShowForm("Protect Chat History", "Protect", "Skip", []*widget.FormItem{
+		item,
+		widget.NewFormItem("Confirm", confirm),
+	}, func(ok bool) {
+		if !ok {
+			passphrase.SetText("")
+		}
+		app.createChatHistory(passphrase.Text)
+	}, app.main)
+}
+
+// createChatHistory opens a new chat history, protected by a passphrase if one is given.
+func (app *App) createChatHistory(passphrase string) {
+	if passphrase == "" {
+		key, err := app.chatStoreInstallKey()
+		if err != nil {
+			app.log.Error("error opening chat history", "error", err.Error())
+			return
+		}
+		app.onChatHistoryKey(key)
+		return
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		app.log.Error("error generating chat history salt", "error", err.Error())
+		dialog.ShowError(err, app.main)
+		return
+	}
+	app.Preferences().SetString(preferenceChatHistorySalt, base64.StdEncoding.EncodeToString(salt))
+	app.onChatHistoryKey(deriveRoomKey(passphrase, salt))
+}
+
+// applyChatHistory applies the chat history preferences. A passphrase is only
+// changed if one is given.
+func (app *App) applyChatHistory(enabled, protect bool, passphrase string) {
+	app.Preferences().SetBool(preferenceChatHistory, enabled)
+	if !enabled {
+		app.chatHistory.Store(nil)
+		return
+	}
+	protected := app.Preferences().String(preferenceChatHistorySalt) != ""
+	if !protected && app.Preferences().String(preferenceChatHistoryKey) == "" && app.chatHistory.Load() == nil {
+		// There is no history yet, so it is created with the chosen protection.
+		if !protect {
+			passphrase = ""
+		}
+		app.createChatHistory(passphrase)
+		return
+	}
+	app.openChatHistory()
+	if protect == protected && (!protect || passphrase == "") {
+		return
+	}
+	store := app.chatHistory.Load()
+	if store == nil {
+		dialog.ShowError(errors.New("unlock the chat history before changing its passphrase"), app.main)
+		return
+	}
+	var key, salt []byte
+	if protect {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			app.log.Error("error generating chat history salt", "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
+		key = deriveRoomKey(passphrase, salt)
+	} else {
+		app.Preferences().SetString(preferenceChatHistoryKey, "")
+		var err error
+		if key, err = app.chatStoreInstallKey(); err != nil {
+			app.log.Error("error generating chat history key", "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
+	}
+	// The new salt is saved before the history written under the new key replaces
+	// the old one, so the saved preferences always open the history.
+	err := store.rekey(key, func() {
+		if protect {
+			app.Preferences().SetString(preferenceChatHistorySalt, base64.StdEncoding.EncodeToString(salt))
+			app.Preferences().SetString(preferenceChatHistoryKey, "")
+		} else {
+			app.Preferences().SetString(preferenceChatHistorySalt, "")
+		}
+	})
+	if err != nil {
+		app.log.Error("error encrypting chat history", "error", err.Error())
+		dialog.ShowError(err, app.main)
+	}
+}
+
+// clearChatHistory deletes the chat history, along with its passphrase if it is locked.
+func (app *App) clearChatHistory() {
+	var err error
+	if store := app.chatHistory.Load(); store != nil {
+		err = store.clear()
+	} else if err = os.Remove(filepath.Join(app.Storage().RootURI().Path(), chatStoreFile)); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		app.log.Error("error clearing chat history", "error", err.Error())
+		dialog.ShowError(err, app.main)
+		return
+	}
+	if app.chatHistory.Load() == nil {
+		app.Preferences().SetString(preferenceChatHistorySalt, "")
+		app.openChatHistory()
+	}
+	if !app.connected.Load() {
+		app.showOffline()
+	}
+}
+
+// unlockChatHistory asks for the passphrase protecting the chat history and opens it.
+func (app *App) unlockChatHistory(salt []byte) {
+	passphrase := widget.NewPasswordEntry()
+	dialog.ShowForm("Unlock Chat History", "Unlock", "Skip", []*widget.FormItem{
+		widget.NewFormItem("Passphrase", passphrase),
+	}, func(ok bool) {
+		if !ok {
+			app.log.Info("chat history left locked")
+			return
+		}
+		err := app.onChatHistoryKey(deriveRoomKey(passphrase.Text, salt))
+		if errors.Is(err, errChatStoreKey) {
+			dialog.ShowError(err, app.main)
+			app.unlockChatHistory(salt)
+		}
+	}, app.main)
+}
+
+// onChatHistoryKey opens the chat history with a key and shows it if we are offline.
+func (app *App) onChatHistoryKey(key []byte) error {
+	store, err := openChatStore(app.Storage().RootURI().Path(), key)
+	if err != nil {
+		app.log.Error("error opening chat history", "error", err.Error())
+		return err
+	}
+	if store.skipped > 0 {
+		app.log.Warn("skipped corrupt chat history records", "count", store.skipped)
+	}
+	app.chatHistory.Store(store)
+	go app.indexStoredHistory(store)
+	if !app.connected.Load() {
+		app.showOffline()
+	}
+	return nil
+}
+
+// showOffline shows the stored chat history while we are not connected. Rooms can
+// be read but nothing can be sent.
+func (app *App) showOffline() {
+	store := app.chatHistory.Load()
+	if store == nil {
+		return
+	}
+	app.closeSelectedRoom()
+	if id, _ := app.nodeID.Get(); id == "" {
+		app.nodeID.Set(app.Preferences().String(preferenceLastNodeID))
+	}
+	for id, value := range store.profileValues() {
+		app.onProfile(ProfilePath(id), value)
+	}
+	for name, value := range store.roomInfos() {
+		if info, err := DecodeRoomInfo(value); err == nil {
+			app.setRoomInfo(name, info)
+		}
+	}
+	var rooms []string
+	for _, roomName := range app.joinedRooms() {
+		if !isDirectRoom(roomName) {
+			rooms = append(rooms, roomName)
+		}
+	}
+	app.roomsList.Set(rooms)
+	app.refreshDirectList()
+	app.chatInput.Disable()
+	app.threadInput.Disable()
+	app.chatContainer.Show()
+}
+
+// showOnline shows the chat once we are connected, closing any room being read offline.
+func (app *App) showOnline() {
+	app.closeSelectedRoom()
+	app.chatInput.Enable()
+	app.threadInput.Enable()
+	app.chatContainer.Show()
+}
+
+// closeSelectedRoom unselects the selected room without the list handlers running.
+func (app *App) closeSelectedRoom() {
+	app.chatContainer.Hide()
+	app.roomsListWidget.UnselectAll()
+	app.directListWidget.UnselectAll()
+	app.chatGrid.Hide()
+	app.cancelRoomSubscription()
+	app.selectedRoom = ""
+	app.transcript.Store(nil)
+	app.presence = nil
+	app.chatHeader.SetText("")
+	app.chatMembers.Set([]string{})
+	app.chatView.Clear()
+	app.closeThread()
+	app.cancelReply()
+}
+
+// loadStoredHistory renders the stored messages of a room, around the message being
+// jumped to if there is one, along with its last known members.
+func (app *App) loadStoredHistory(transcript *chatTranscript, roomName, jump string) {
+	store := app.chatHistory.Load()
+	if store == nil {
+		return
+	}
+	keys := store.messageKeys(roomName)
+	start, end := historyWindow(keys, jump)
+	transcript.setOlder(keys[:start])
+	transcript.insert(app.fetchMessages(context.Background(), nil, keys[start:end])...)
+	transcript.setNewer(keys[end:])
+	app.setChatMembers(store.memberIDs(roomName))
+	app.renderTranscript(transcript)
+	if jump != "" {
+		app.chatView.ScrollToKey(jump)
+	}
+}
+
+// storedMessage returns the value of a message kept in the chat history.
+func (app *App) storedMessage(key string) (string, bool) {
+	store := app.chatHistory.Load()
+	if store == nil {
+		return "", false
+	}
+	return store.message(key)
+}
+
+// hasStoredMessages returns true if all the messages are kept in the chat history.
+func (app *App) hasStoredMessages(keys []string) bool {
+	for _, key := range keys {
+		if _, ok := app.storedMessage(key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// indexStoredHistory adds the messages kept in the chat history to the search index.
+func (app *App) indexStoredHistory(store *chatStore) {
+	for _, roomName := range app.joinedRooms() {
+		for _, key := range store.messageKeys(roomName) {
+			if app.search.has(key) {
+				continue
+			}
+			if value, ok := store.message(key); ok {
+				app.search.add(key, app.openMessage(key, value))
+			}
+		}
+	}
+}
+
+// recordRoom stores the info of a room in the chat history.
+func (app *App) recordRoom(roomName string, info *RoomInfo) {
+	if app.chatHistory.Load() == nil {
+		return
+	}
+	value, err := info.Encode()
+	if err != nil {
+		app.log.Error("error recording room", "room", roomName, "error", err.Error())
+		return
+	}
+	app.record(&chatRecord{Kind: "room", Key: roomName, Value: value})
+}
+
+// recordMessage stores a message in the chat history.
+func (app *App) recordMessage(key, value string) {
+	app.record(&chatRecord{Kind: "message", Key: key, Value: value})
+}
+
+// recordMember stores the membership of a node in a room in the chat history.
+func (app *App) recordMember(roomName, nodeID, value string) {
+	app.record(&chatRecord{Kind: "member", Room: roomName, Key: nodeID, Value: value})
+}
+
+// recordMembers stores the current members of a room in the chat history, marking
+// the nodes no longer listed as having left.
+func (app *App) recordMembers(roomName string, members []string) {
+	store := app.chatHistory.Load()
+	if store == nil {
+		return
+	}
+	for _, id := range store.memberIDs(roomName) {
+		if !slices.Contains(members, id) {
+			app.recordMember(roomName, id, memberLeft)
+		}
+	}
+	for _, id := range members {
+		app.recordMember(roomName, id, "")
+	}
+}
+
+// recordProfile stores the profile of a node in the chat history.
+func (app *App) recordProfile(nodeID, value string) {
+	app.record(&chatRecord{Kind: "profile", Key: nodeID, Value: value})
+}
+
+// record stores a record in the chat history if it is open.
+func (app *App) record(rec *chatRecord) {
+	store := app.chatHistory.Load()
+	if store == nil {
+		return
+	}
+	if err := store.put(rec); err != nil {
+		app.log.Error("error recording chat history", "kind", rec.Kind, "error", err.Error())
+	}
+}
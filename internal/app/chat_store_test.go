@@ -0,0 +1,244 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestChatStore returns a chat history in a temporary directory holding the given
+// messages of a room.
+func newTestChatStore(t *testing.T, key []byte, bodies ...string) (*chatStore, []string) {
+	dir := t.TempDir()
+	s, err := openChatStore(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(bodies))
+	for i, body := range bodies {
+		keys[i] = MessagesPath("room") + "/" + string(rune('a'+i)) + "/node"
+		if err := s.put(&chatRecord{Kind: "message", Key: keys[i], Value: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, keys
+}
+
+// checkMessages fails the test unless the store holds the messages at the keys.
+func checkMessages(t *testing.T, s *chatStore, keys []string, bodies ...string) {
+	t.Helper()
+	for i, key := range keys {
+		value, ok := s.message(key)
+		if bodies[i] == "" {
+			if ok {
+				t.Errorf("message %s was not dropped", key)
+			}
+			continue
+		}
+		if !ok || value != bodies[i] {
+			t.Errorf("message %s is %q, want %q", key, value, bodies[i])
+		}
+	}
+}
+
+func TestChatStoreReopen(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	s, keys := newTestChatStore(t, key, "one", "two")
+	reopened, err := openChatStore(filepath.Dir(s.path), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, reopened, keys, "one", "two")
+	if _, err := openChatStore(filepath.Dir(s.path), bytes.Repeat([]byte{2}, 32)); !errors.Is(err, errChatStoreKey) {
+		t.Fatalf("opened with the wrong key: %v", err)
+	}
+}
+
+func TestChatStoreSkipsCorruptRecords(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	s, keys := newTestChatStore(t, key, "one", "two", "three")
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in the ciphertext of the second record.
+	first := 4 + int(binary.LittleEndian.Uint32(data))
+	data[first+10] ^= 0xff
+	// Leave a partial record at the end, as an interrupted write would.
+	data = append(data, 9, 0, 0, 0, 1)
+	if err := os.WriteFile(s.path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openChatStore(filepath.Dir(s.path), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.skipped != 1 {
+		t.Errorf("skipped %d records, want 1", reopened.skipped)
+	}
+	checkMessages(t, reopened, keys, "one", "", "three")
+	info, err := os.Stat(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)-5) {
+		t.Errorf("history is %d bytes, want the partial record dropped", info.Size())
+	}
+}
+
+func TestChatStoreRewrite(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	s, keys := newTestChatStore(t, key, "one", "two")
+	if err := s.put(&chatRecord{Kind: "message", Key: keys[0], Value: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	err := s.rewrite()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.records != 2 {
+		t.Errorf("rewrote %d records, want 2", s.records)
+	}
+	reopened, err := openChatStore(filepath.Dir(s.path), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, reopened, keys, "edited", "two")
+}
+
+func TestChatStoreRekey(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	s, keys := newTestChatStore(t, oldKey, "one")
+	dir := filepath.Dir(s.path)
+	before, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved bool
+	if err := s.rekey(newKey, func() {
+		// The history is left as it was until the new key is saved.
+		if data, err := os.ReadFile(s.path); err != nil || !bytes.Equal(data, before) {
+			t.Errorf("history replaced before the new key is saved: %v", err)
+		}
+		saved = true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !saved {
+		t.Fatal("new key was not saved")
+	}
+	reopened, err := openChatStore(dir, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, reopened, keys, "one")
+}
+
+func TestChatStoreFinishesInterruptedRekey(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	s, keys := newTestChatStore(t, oldKey, "one")
+	dir := filepath.Dir(s.path)
+	// Write the history under the new key as rekey does, without swapping it in.
+	rekeyed, err := openChatStore(t.TempDir(), newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rekeyed.mu.Lock()
+	rekeyed.messages, rekeyed.path = s.messages, s.path
+	_, err = rekeyed.writeFile(s.path + chatStoreRekeySuffix)
+	rekeyed.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening with the old key means the new key was never saved.
+	if _, err := openChatStore(dir, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.path + chatStoreRekeySuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unsaved rekey was kept: %v", err)
+	}
+	rekeyed.mu.Lock()
+	_, err = rekeyed.writeFile(s.path + chatStoreRekeySuffix)
+	rekeyed.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening with the new key completes the swap.
+	reopened, err := openChatStore(dir, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, reopened, keys, "one")
+}
+
+func TestChatStoreSetsAsideUnreadableHistory(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	dir := t.TempDir()
+	path := filepath.Join(dir, chatStoreFile)
+	// A record too short to hold a nonce cannot have been sealed with any key.
+	if err := os.WriteFile(path, []byte{3, 0, 0, 0, 1, 2, 3}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openChatStore(dir, key)
+	if err != nil {
+		t.Fatalf("corrupt history taken as the wrong key: %v", err)
+	}
+	if s.skipped != 1 {
+		t.Errorf("skipped %d records, want 1", s.skipped)
+	}
+	if _, err := os.Stat(path + chatStoreCorruptSuffix); err != nil {
+		t.Errorf("corrupt history was not kept aside: %v", err)
+	}
+}
+
+func TestChatStoreReadOnlyAfterFailedRekey(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	s, keys := newTestChatStore(t, oldKey, "one")
+	dir := filepath.Dir(s.path)
+	// Make the swap fail by putting a directory where the history is.
+	err := s.rekey(newKey, func() {
+		if err := os.Remove(s.path); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(s.path, "blocker"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err == nil {
+		t.Fatal("expected the swap to fail")
+	}
+	// Appending to the directory would fail, so nothing must be appended.
+	if err := s.put(&chatRecord{Kind: "message", Key: keys[0], Value: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(s.path); err != nil {
+		t.Fatal(err)
+	}
+	// The swap finishes when the history is opened with the new key.
+	reopened, err := openChatStore(dir, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, reopened, keys, "one")
+}
@@ -0,0 +1,473 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// chatEntry is a single entry in a room's transcript.
+type chatEntry struct {
+	// key is the storage key the entry came from. It is used to de-duplicate
+	// entries seen both in history and on the live subscription.
+	key string
+	// time is used to order the entry in the transcript.
+	time time.Time
+	// message is set for chat messages.
+	message *ChatMessage
+	// event is set for room events such as members joining.
+	event string
+	// member is the node the event is about. Its name is shown before the event.
+	member string
+	// revision is the latest honored edit or deletion of the message.
+	revision *ChatMessage
+	// replies is the number of loaded replies in the thread the message started.
+	replies int
+	// reactions are the reactions to the message, most popular first.
+	reactions []reactionCount
+}
+
+// current returns the message as last revised by its sender.
+func (e *chatEntry) current() *ChatMessage {
+	if e.revision != nil {
+		return e.revision
+	}
+	return e.message
+}
+
+// edited returns true if the message has been edited by its sender.
+func (e *chatEntry) edited() bool {
+	return e.revision != nil && e.revision.ContentType != ContentTypeTombstone
+}
+
+// deleted returns true if the message has been deleted by its sender.
+func (e *chatEntry) deleted() bool {
+	return e.revision != nil && e.revision.ContentType == ContentTypeTombstone
+}
+
+// chatTranscriptWindow is the most entries a transcript keeps in memory. Entries
+// scrolled out of the window are dropped and reloaded from the room's history
+// when they are scrolled back into view.
+const chatTranscriptWindow = 500
+
+// chatTranscript holds a window of the entries of a room in time order along with
+// the keys of stored messages on either side of it that are not loaded.
+type chatTranscript struct {
+	mu      sync.Mutex
+	room    string
+	entries []*chatEntry
+	// seen are the keys of the loaded entries and of the older and newer messages.
+	seen map[string]struct{}
+	// older are the keys of stored messages older than the loaded entries, oldest first.
+	older []string
+	// newer are the keys of stored messages newer than the loaded entries, oldest first.
+	newer []string
+	// events are the membership events that arrived while newer messages were not
+	// loaded. They have no key to reload them by, so they are kept until the newer
+	// messages around them are.
+	events []*chatEntry
+	// scrolledUp is set while the view is not following new entries. New entries
+	// are then queued with the newer messages once the window is full, rather than
+	// dropping the oldest entries the view may be showing.
+	scrolledUp bool
+	// revisions are the edits and deletions seen for each message ID. They are kept
+	// so they can be applied when the message they revise is loaded.
+	revisions map[string][]*chatEntry
+	// replies are the keys of the replies seen in each thread.
+	replies map[string]map[string]struct{}
+	// reactions are the nodes that reacted to each message key with each reaction.
+	reactions map[string]map[string]map[string]struct{}
+	// honor optionally decides if a revision from the original sender is applied,
+	// such as when its signature does not verify.
+	honor func(original, revision *chatEntry) bool
+}
+
+// newChatTranscript returns an empty transcript for the given room.
+func newChatTranscript(room string) *chatTranscript {
+	return &chatTranscript{
+		room:      room,
+		seen:      make(map[string]struct{}),
+		revisions: make(map[string][]*chatEntry),
+		replies:   make(map[string]map[string]struct{}),
+		reactions: make(map[string]map[string]map[string]struct{}),
+	}
+}
+
+// insert adds the entries that have not been seen before and returns how many
+// were added. If newer messages are not loaded, or the view is scrolled up and the
+// window is full, new entries after the window are queued with the newer messages
+// instead. Otherwise the oldest entries are dropped if the window is full.
+func (t *chatTranscript) insert(entries ...*chatEntry) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var added int
+	for _, e := range entries {
+		if e.key != "" {
+			if _, ok := t.seen[e.key]; ok {
+				continue
+			}
+			t.seen[e.key] = struct{}{}
+		}
+		added++
+		if t.queueNewer(e) {
+			continue
+		}
+		t.place(e)
+	}
+	t.trimOldest()
+	return added
+}
+
+// queueNewer queues an entry after the window with the newer messages and returns
+// true if they are not loaded, or if the view is scrolled up and the window is full.
+// The caller must hold the lock.
+func (t *chatTranscript) queueNewer(e *chatEntry) bool {
+	if len(t.entries) > 0 && t.entries[len(t.entries)-1].time.After(e.time) {
+		return false
+	}
+	full := t.scrolledUp && len(t.entries) >= chatTranscriptWindow
+	if len(t.newer) == 0 && len(t.events) == 0 && !full {
+		return false
+	}
+	if e.key != "" {
+		t.newer = append(t.newer, e.key)
+	} else {
+		t.events = append(t.events, e)
+	}
+	return true
+}
+
+// setScrolledUp records whether the view is scrolled up from the newest entries.
+func (t *chatTranscript) setScrolledUp(scrolledUp bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.scrolledUp = scrolledUp
+}
+
+// insertOlder adds a page of entries loaded for keys taken with takeOlder. The
+// newest entries are dropped if the window is full.
+func (t *chatTranscript) insertOlder(entries ...*chatEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range entries {
+		t.place(e)
+	}
+	if over := len(t.entries) - chatTranscriptWindow; over > 0 {
+		var keys []string
+		for _, e := range t.entries[len(t.entries)-over:] {
+			if e.key != "" {
+				keys = append(keys, e.key)
+			}
+		}
+		t.newer = append(keys, t.newer...)
+		t.entries = t.entries[:len(t.entries)-over]
+	}
+}
+
+// insertNewer adds a page of entries loaded for keys taken with takeNewer, along
+// with the queued events they reach. The oldest entries are dropped if the window
+// is full.
+func (t *chatTranscript) insertNewer(entries ...*chatEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range entries {
+		t.place(e)
+	}
+	var n int
+	for n < len(t.events) && (len(t.newer) == 0 || len(t.entries) == 0 || !t.events[n].time.After(t.entries[len(t.entries)-1].time)) {
+		t.place(t.events[n])
+		n++
+	}
+	t.events = t.events[n:]
+	t.trimOldest()
+}
+
+// place inserts an entry in time order. Revisions are applied to the message they
+// revise instead. The caller must hold the lock.
+func (t *chatTranscript) place(e *chatEntry) {
+	if e.message != nil && e.message.Replaces != "" {
+		t.revise(e)
+		return
+	}
+	if e.message != nil {
+		e.replies = len(t.replies[e.message.ID])
+		e.reactions = summarizeReactions(t.reactions[e.key])
+		if len(t.revisions[e.message.ID]) > 0 {
+			e = t.applyRevisions(e)
+		}
+		if e.message.Reply != nil {
+			t.addReply(e)
+		}
+	}
+	// Entries almost always arrive in order, so search from the end.
+	i := len(t.entries)
+	for i > 0 && t.entries[i-1].time.After(e.time) {
+		i--
+	}
+	t.entries = append(t.entries, nil)
+	copy(t.entries[i+1:], t.entries[i:])
+	t.entries[i] = e
+}
+
+// revise records a revision and applies it if the message it revises is loaded.
+// The caller must hold the lock.
+func (t *chatTranscript) revise(rev *chatEntry) {
+	id := rev.message.Replaces
+	for _, seen := range t.revisions[id] {
+		if seen.key == rev.key {
+			return
+		}
+	}
+	t.revisions[id] = append(t.revisions[id], rev)
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		if e := t.entries[i]; e.message != nil && e.message.ID == id {
+			// Entries are replaced rather than modified so views see the change.
+			t.entries[i] = t.applyRevisions(e)
+			return
+		}
+	}
+}
+
+// react adds or removes a reaction and returns true if the reactions changed. Reactions to messages that are not loaded are kept until
+// they are.
+func (t *chatTranscript) react(r *reactionEvent) bool {
+	messageKey, reaction, nodeID, added := r.messageKey, r.reaction, r.nodeID, r.added
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reactions, ok := t.reactions[messageKey]
+	if !ok {
+		reactions = make(map[string]map[string]struct{})
+		t.reactions[messageKey] = reactions
+	}
+	nodes, ok := reactions[reaction]
+	if !ok {
+		// Peers can publish any reaction, so only so many are kept for a message.
+		if !added || len(reactions) >= maxMessageReactions {
+			return false
+		}
+		nodes = make(map[string]struct{})
+		reactions[reaction] = nodes
+	}
+	if _, ok := nodes[nodeID]; ok == added {
+		return false
+	}
+	if added {
+		nodes[nodeID] = struct{}{}
+	} else {
+		delete(nodes, nodeID)
+		if len(nodes) == 0 {
+			delete(reactions, reaction)
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		if e := t.entries[i]; e.key == messageKey {
+			reacted := *e
+			reacted.reactions = summarizeReactions(reactions)
+			t.entries[i] = &reacted
+			break
+		}
+	}
+	return true
+}
+
+// addReply counts a reply in its thread and updates the reply count of the message
+// that started it if it is loaded. The caller must hold the lock.
+func (t *chatTranscript) addReply(e *chatEntry) {
+	id := e.message.Reply.ID
+	keys, ok := t.replies[id]
+	if !ok {
+		keys = make(map[string]struct{})
+		t.replies[id] = keys
+	}
+	if _, ok := keys[e.key]; ok {
+		return
+	}
+	keys[e.key] = struct{}{}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		if parent := t.entries[i]; parent.message != nil && parent.message.ID == id {
+			counted := *parent
+			counted.replies = len(keys)
+			t.entries[i] = &counted
+			return
+		}
+	}
+}
+
+// applyRevisions returns the entry with the latest revision from its sender applied.
+// A deletion is final. The caller must hold the lock.
+func (t *chatTranscript) applyRevisions(e *chatEntry) *chatEntry {
+	var best *chatEntry
+	for _, rev := range t.revisions[e.message.ID] {
+		if !t.honored(e, rev) {
+			continue
+		}
+		switch {
+		case best != nil && best.message.ContentType == ContentTypeTombstone:
+		case best == nil, rev.message.ContentType == ContentTypeTombstone, rev.time.After(best.time):
+			best = rev
+		}
+	}
+	if best == nil || best.message == e.revision {
+		return e
+	}
+	revised := *e
+	revised.revision = best.message
+	return &revised
+}
+
+// honored returns true if a revision was published by the sender of the original message.
+// The caller must hold the lock.
+func (t *chatTranscript) honored(original, rev *chatEntry) bool {
+	origFrom, _ := parseMessageKey(original.key)
+	revFrom, _ := parseMessageKey(rev.key)
+	if rev.message.From != original.message.From || origFrom != original.message.From || revFrom != rev.message.From {
+		return false
+	}
+	return t.honor == nil || t.honor(original, rev)
+}
+
+// trimOldest drops the oldest entries beyond the window, keeping the keys of
+// stored messages so they can be reloaded. The caller must hold the lock.
+func (t *chatTranscript) trimOldest() {
+	over := len(t.entries) - chatTranscriptWindow
+	if over <= 0 {
+		return
+	}
+	for _, e := range t.entries[:over] {
+		if e.key != "" {
+			t.older = append(t.older, e.key)
+		}
+	}
+	// Clear the dropped entries so they can be collected, and reslice rather than
+	// copy so trimming stays cheap. The backing array is replaced as appends grow it.
+	clear(t.entries[:over])
+	t.entries = t.entries[over:]
+}
+
+// setOlder adds keys of stored messages that precede the loaded entries.
+func (t *chatTranscript) setOlder(keys []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.older = t.mergeKeys(t.older, keys)
+}
+
+// setNewer adds keys of stored messages that follow the loaded entries.
+func (t *chatTranscript) setNewer(keys []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.newer = t.mergeKeys(t.newer, keys)
+}
+
+// mergeKeys adds the keys that have not been seen to a list of keys and keeps it
+// oldest first. The caller must hold the lock.
+func (t *chatTranscript) mergeKeys(list, keys []string) []string {
+	var added bool
+	// Clip so appending never writes into a page returned by takeOlder or takeNewer.
+	list = slices.Clip(list)
+	for _, key := range keys {
+		if _, ok := t.seen[key]; ok {
+			continue
+		}
+		t.seen[key] = struct{}{}
+		list = append(list, key)
+		added = true
+	}
+	if added {
+		sortMessageKeys(list)
+	}
+	return list
+}
+
+// hasOlder returns true if there are older stored messages that have not been loaded.
+func (t *chatTranscript) hasOlder() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.older) > 0
+}
+
+// hasNewer returns true if there are newer stored messages or events that have not
+// been loaded.
+func (t *chatTranscript) hasNewer() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.newer) > 0 || len(t.events) > 0
+}
+
+// takeOlder removes and returns up to n of the newest keys older than the window.
+func (t *chatTranscript) takeOlder(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n > len(t.older) {
+		n = len(t.older)
+	}
+	page := t.older[len(t.older)-n:]
+	t.older = t.older[:len(t.older)-n]
+	return page
+}
+
+// takeNewer removes and returns up to n of the oldest keys newer than the window.
+func (t *chatTranscript) takeNewer(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n > len(t.newer) {
+		n = len(t.newer)
+	}
+	page := t.newer[:n]
+	t.newer = t.newer[n:]
+	return page
+}
+
+// snapshot returns a copy of the entries in time order.
+func (t *chatTranscript) snapshot() []*chatEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]*chatEntry, len(t.entries))
+	copy(out, t.entries)
+	return out
+}
+
+// thread returns the loaded message that started a thread followed by its replies.
+func (t *chatTranscript) thread(id string) []*chatEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []*chatEntry
+	for _, e := range t.entries {
+		if e.message == nil {
+			continue
+		}
+		if e.message.ID == id || (e.message.Reply != nil && e.message.Reply.ID == id) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// sortMessageKeys sorts message keys by their timestamp, oldest first. The
+// timestamps are not compared as strings because RFC3339Nano trims trailing zeros.
+func sortMessageKeys(keys []string) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		_, ti := parseMessageKey(keys[i])
+		_, tj := parseMessageKey(keys[j])
+		if ti.Equal(tj) {
+			return keys[i] < keys[j]
+		}
+		return ti.Before(tj)
+	})
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"path"
+	"testing"
+	"time"
+)
+
+// testEpoch is the time of the first test message.
+var testEpoch = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestEntry returns the entry of the i-th message sent to a room, a second apart.
+func newTestEntry(roomName string, i int) *chatEntry {
+	t := testEpoch.Add(time.Duration(i) * time.Second)
+	from := fmt.Sprintf("node-%d", i%3)
+	return &chatEntry{
+		key:  path.Join(MessagesPath(roomName), t.Format(time.RFC3339Nano), from),
+		time: t,
+		message: &ChatMessage{
+			Version:     ChatMessageVersion,
+			ID:          fmt.Sprintf("msg-%d", i),
+			From:        from,
+			SentAt:      t,
+			ContentType: ContentTypeText,
+			Body:        fmt.Sprintf("message number %d with a few words of text", i),
+		},
+	}
+}
+
+// fillTranscript returns a transcript of a room with n messages inserted one at a time.
+func fillTranscript(roomName string, n int) *chatTranscript {
+	t := newChatTranscript(roomName)
+	for i := 0; i < n; i++ {
+		t.insert(newTestEntry(roomName, i))
+	}
+	return t
+}
+
+func TestTranscriptTrimsOldestWhileFollowing(t *testing.T) {
+	tr := fillTranscript("room", chatTranscriptWindow+10)
+	entries := tr.snapshot()
+	if len(entries) != chatTranscriptWindow {
+		t.Fatalf("expected %d entries, got %d", chatTranscriptWindow, len(entries))
+	}
+	if want := newTestEntry("room", 10).key; entries[0].key != want {
+		t.Errorf("expected oldest entry %q, got %q", want, entries[0].key)
+	}
+	if got := len(tr.takeOlder(historyPageSize)); got != 10 {
+		t.Errorf("expected 10 older keys, got %d", got)
+	}
+}
+
+func TestTranscriptQueuesNewerWhileScrolledUp(t *testing.T) {
+	tr := fillTranscript("room", chatTranscriptWindow)
+	first := tr.snapshot()[0]
+	tr.setScrolledUp(true)
+	next := newTestEntry("room", chatTranscriptWindow)
+	if added := tr.insert(next); added != 1 {
+		t.Fatalf("expected 1 entry added, got %d", added)
+	}
+	entries := tr.snapshot()
+	if len(entries) != chatTranscriptWindow || entries[0] != first {
+		t.Fatalf("expected the window to be kept while scrolled up")
+	}
+	if keys := tr.takeNewer(historyPageSize); len(keys) != 1 || keys[0] != next.key {
+		t.Fatalf("expected the new message to be queued, got %v", keys)
+	}
+	tr.insertNewer(next)
+	if entries := tr.snapshot(); entries[len(entries)-1] != next {
+		t.Errorf("expected the queued message to be loaded last")
+	}
+}
+
+func TestTranscriptKeepsEventsWhileNewerPending(t *testing.T) {
+	tr := fillTranscript("room", 5)
+	pending := newTestEntry("room", 6)
+	tr.setNewer([]string{pending.key})
+	event := &chatEntry{time: pending.time.Add(time.Second), event: "joined the room", member: "node-9"}
+	if added := tr.insert(event); added != 1 {
+		t.Fatalf("expected 1 entry added, got %d", added)
+	}
+	if !tr.hasNewer() {
+		t.Fatal("expected newer entries to be pending")
+	}
+	if keys := tr.takeNewer(historyPageSize); len(keys) != 1 || keys[0] != pending.key {
+		t.Fatalf("expected the pending message to be taken, got %v", keys)
+	}
+	tr.insertNewer(newTestEntry("room", 6))
+	if tr.hasNewer() {
+		t.Error("expected no newer entries to be pending")
+	}
+	entries := tr.snapshot()
+	if len(entries) != 7 || entries[6] != event {
+		t.Fatalf("expected the event to follow the loaded message, got %d entries", len(entries))
+	}
+}
+
+// BenchmarkTranscriptInsert measures inserting a live message into rooms with
+// increasing history. The cost should not grow with the size of the room.
+func BenchmarkTranscriptInsert(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("messages=%d", n), func(b *testing.B) {
+			tr := fillTranscript("bench", n)
+			entries := make([]*chatEntry, b.N)
+			for i := range entries {
+				entries[i] = newTestEntry("bench", n+i)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for _, e := range entries {
+				tr.insert(e)
+				tr.snapshot()
+			}
+		})
+	}
+}
+
+func TestTranscriptLimitsReactions(t *testing.T) {
+	tr := fillTranscript("room", 1)
+	messageKey := tr.snapshot()[0].key
+	for i := 0; i < maxMessageReactions+5; i++ {
+		tr.react(&reactionEvent{messageKey: messageKey, reaction: fmt.Sprintf("r%d", i), nodeID: "node", added: true})
+	}
+	if got := len(tr.snapshot()[0].reactions); got != maxMessageReactions {
+		t.Fatalf("expected %d reactions, got %d", maxMessageReactions, got)
+	}
+	// Taking a reaction back frees its place for another.
+	tr.react(&reactionEvent{messageKey: messageKey, reaction: "r0", nodeID: "node"})
+	if !tr.react(&reactionEvent{messageKey: messageKey, reaction: "new", nodeID: "node", added: true}) {
+		t.Fatal("expected a reaction to be kept after one was taken back")
+	}
+}
@@ -0,0 +1,953 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// chatThumbnailSize is the height of image attachment thumbnails.
+const chatThumbnailSize = 160
+
+// chatGroupWindow is how close together consecutive messages from the same
+// sender must be to be grouped under a single header.
+const chatGroupWindow = time.Minute * 5
+
+// chatView is a virtualized list of transcript entries. Only the rows in view are
+// rendered. Messages are word wrapped and grouped by sender, and the view follows
+// new entries unless the user has scrolled up.
+type chatView struct {
+	widget.BaseWidget
+
+	// OnScrolledToTop is called when the top of the loaded entries comes into view.
+	OnScrolledToTop func()
+	// OnScrolledToBottom is called when the bottom of the loaded entries comes into view.
+	OnScrolledToBottom func()
+	// Menu returns the context menu for an entry, or nil for none.
+	Menu func(*chatEntry) *fyne.Menu
+	// Verify returns the verification status of an entry's sender.
+	Verify func(*chatEntry) verifyStatus
+	// Thumbnail returns the image of an image attachment, or nil if it is not loaded.
+	Thumbnail func(*chatEntry) image.Image
+	// OpenThread is called when the reply count of a message is tapped.
+	OpenThread func(*chatEntry)
+	// ReactionMenu returns the reaction picker shown when the reactions to a message are tapped.
+	ReactionMenu func(*chatEntry) *fyne.Menu
+	// Threaded hides quotes and reply counts, for views of a single thread.
+	Threaded bool
+	// CopyText copies text to the clipboard, such as from code blocks.
+	CopyText func(string)
+	// OnFollowChanged is called when the view starts or stops following new entries.
+	OnFollowChanged func(following bool)
+
+	ourID    binding.String
+	profiles *profileDirectory
+	scroll   *container.Scroll
+	content  *fyne.Container
+
+	mu      sync.Mutex
+	entries []*chatEntry
+	layouts []chatRowLayout
+	// offsets are the vertical positions of each row, with a final element for the total height.
+	offsets []float32
+	width   float32
+	// wrapped caches the wrapped lines of each entry at the current width.
+	wrapped map[*chatEntry][]string
+	// rich caches the rendered body of each Markdown entry.
+	rich map[*chatEntry]*widget.RichText
+	// plain are the IDs of Markdown messages shown as plain text.
+	plain map[string]bool
+	// follow indicates the view should stay scrolled to the newest entry.
+	follow  bool
+	visible map[*chatEntry]*chatRow
+	pool    []*chatRow
+}
+
+// chatRowLayout is the computed layout of a single row.
+type chatRowLayout struct {
+	header bool
+	// warning is shown in the header if the sender could not be verified.
+	warning string
+	// thumbnail is set if space is reserved below the lines for an image thumbnail.
+	thumbnail bool
+	// quote is set if the first line quotes the message replied to.
+	quote bool
+	// reactions is set if the line after the body shows the reactions to the message.
+	reactions bool
+	// replies is set if the last line is the reply count of a thread.
+	replies bool
+	// rich is the rendered body of a Markdown message, shown in place of body lines.
+	rich       *widget.RichText
+	richHeight float32
+	lines      []string
+	height     float32
+}
+
+// bodyLine returns the index of the first body line, which is where rich text is shown.
+func (l chatRowLayout) bodyLine() int {
+	if l.quote {
+		return 1
+	}
+	return 0
+}
+
+// lineY returns the vertical position of a line within the row.
+func (l chatRowLayout) lineY(i int) float32 {
+	y := theme.Padding() + float32(i)*chatLineHeight()
+	if l.header {
+		y += chatLineHeight()
+	}
+	if l.rich != nil && i >= l.bodyLine() {
+		y += l.richHeight
+	}
+	return y
+}
+
+// quoteLine returns the index of the quote line, or -1 if there is none.
+func (l chatRowLayout) quoteLine() int {
+	if !l.quote {
+		return -1
+	}
+	return 0
+}
+
+// reactionsLine returns the index of the reactions line, or -1 if there is none.
+func (l chatRowLayout) reactionsLine() int {
+	if !l.reactions {
+		return -1
+	}
+	if l.replies {
+		return len(l.lines) - 2
+	}
+	return len(l.lines) - 1
+}
+
+// repliesLine returns the index of the reply count line, or -1 if there is none.
+func (l chatRowLayout) repliesLine() int {
+	if !l.replies {
+		return -1
+	}
+	return len(l.lines) - 1
+}
+
+// newChatView returns a new, empty chat view. Messages from ourID are styled as our own
+// and senders are named from their profiles.
+func newChatView(ourID binding.String, profiles *profileDirectory) *chatView {
+	v := &chatView{
+		ourID:    ourID,
+		profiles: profiles,
+		follow:   true,
+		wrapped:  make(map[*chatEntry][]string),
+		rich:     make(map[*chatEntry]*widget.RichText),
+		plain:    make(map[string]bool),
+		visible:  make(map[*chatEntry]*chatRow),
+		offsets:  []float32{0},
+	}
+	v.content = container.New(&chatViewLayout{view: v})
+	v.scroll = container.NewVScroll(v.content)
+	v.scroll.OnScrolled = v.onScrolled
+	v.ExtendBaseWidget(v)
+	return v
+}
+
+// SetEntries replaces the entries in the view. If the view is following new entries
+// it scrolls to the bottom, otherwise the entry at the top of the view stays in place.
+// Rows whose entries are unchanged keep their layout, including when entries were
+// dropped from the top, so only new and changed rows are laid out again.
+func (v *chatView) SetEntries(entries []*chatEntry) {
+	v.mu.Lock()
+	n := len(v.entries)
+	// When the oldest entries were dropped the rest moved up, so match from where
+	// the first entry now was.
+	shift := 0
+	if len(entries) > 0 && n > 0 && entries[0] != v.entries[0] {
+		for i := 1; i < n; i++ {
+			if v.entries[i] == entries[0] {
+				shift = i
+				break
+			}
+		}
+	}
+	same := 0
+	for same+shift < n && same < len(entries) && entries[same] == v.entries[same+shift] {
+		same++
+	}
+	if n > 0 && shift == 0 && same == n && len(entries) == n {
+		// Nothing changed.
+		v.mu.Unlock()
+		return
+	}
+	var anchor *chatEntry
+	var anchorDelta float32
+	if !v.follow && len(v.entries) > 0 {
+		i := v.rowAt(v.scroll.Offset.Y)
+		anchor = v.entries[i]
+		anchorDelta = v.scroll.Offset.Y - v.offsets[i]
+	}
+	old := v.entries
+	v.entries = entries
+	if shift > 0 {
+		for _, e := range old[:shift] {
+			delete(v.wrapped, e)
+			delete(v.rich, e)
+		}
+		v.shiftRows(shift, same)
+	}
+	if same+shift < n {
+		v.pruneWrapped()
+	}
+	v.layoutFrom(same)
+	offset := float32(-1)
+	if anchor != nil {
+		for i, e := range v.entries {
+			if e == anchor {
+				offset = v.offsets[i] + anchorDelta
+				break
+			}
+		}
+	}
+	follow := v.follow
+	total := v.offsets[len(v.offsets)-1]
+	v.mu.Unlock()
+	v.content.Resize(fyne.NewSize(v.scroll.Size().Width, total))
+	switch {
+	case follow:
+		v.scroll.ScrollToBottom()
+	case offset >= 0:
+		v.scroll.Offset.Y = offset
+		v.scroll.Refresh()
+	default:
+		v.scroll.Refresh()
+	}
+	v.updateVisible()
+}
+
+// shiftRows moves the layouts of the keep rows starting at row shift to the top,
+// after the rows above them were dropped. The caller must hold the lock.
+func (v *chatView) shiftRows(shift, keep int) {
+	base := v.offsets[shift]
+	copy(v.layouts, v.layouts[shift:shift+keep])
+	v.layouts = v.layouts[:keep]
+	for i := 0; i <= keep; i++ {
+		v.offsets[i] = v.offsets[shift+i] - base
+	}
+	v.offsets = v.offsets[:keep+1]
+	if keep == 0 {
+		return
+	}
+	// The first row no longer has a row above it to be grouped with.
+	layout := v.layoutRow(0)
+	if delta := layout.height - v.layouts[0].height; delta != 0 {
+		for i := 1; i <= keep; i++ {
+			v.offsets[i] += delta
+		}
+	}
+	v.layouts[0] = layout
+}
+
+// Clear removes all entries from the view and resumes following new entries.
+func (v *chatView) Clear() {
+	v.mu.Lock()
+	changed := v.setFollow(true)
+	v.mu.Unlock()
+	v.followChanged(changed)
+	v.SetEntries(nil)
+}
+
+// ScrollToBottom scrolls to the newest entry and resumes following new entries.
+func (v *chatView) ScrollToBottom() {
+	v.mu.Lock()
+	changed := v.setFollow(true)
+	v.mu.Unlock()
+	v.followChanged(changed)
+	v.scroll.ScrollToBottom()
+	v.updateVisible()
+}
+
+// ScrollToKey scrolls the entry with the given key to the top of the view and stops
+// following new entries. It returns false if the entry is not loaded.
+func (v *chatView) ScrollToKey(key string) bool {
+	v.mu.Lock()
+	offset := float32(-1)
+	for i, e := range v.entries {
+		if e.key == key {
+			offset = v.offsets[i]
+			break
+		}
+	}
+	if offset < 0 {
+		v.mu.Unlock()
+		return false
+	}
+	changed := v.setFollow(false)
+	v.mu.Unlock()
+	v.followChanged(changed)
+	v.scroll.Offset.Y = offset
+	v.scroll.Refresh()
+	v.updateVisible()
+	return true
+}
+
+// setFollow sets whether the view follows new entries and returns true if that
+// changed. The caller must hold the lock.
+func (v *chatView) setFollow(follow bool) bool {
+	changed := v.follow != follow
+	v.follow = follow
+	return changed
+}
+
+// followChanged notifies OnFollowChanged if following changed. The caller must not
+// hold the lock.
+func (v *chatView) followChanged(changed bool) {
+	if !changed || v.OnFollowChanged == nil {
+		return
+	}
+	v.mu.Lock()
+	follow := v.follow
+	v.mu.Unlock()
+	v.OnFollowChanged(follow)
+}
+
+func (v *chatView) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(v.scroll)
+}
+
+func (v *chatView) Resize(size fyne.Size) {
+	v.BaseWidget.Resize(size)
+	v.mu.Lock()
+	changed := v.width != size.Width
+	if changed {
+		v.width = size.Width
+		v.wrapped = make(map[*chatEntry][]string)
+		v.relayout()
+	}
+	follow := v.follow
+	v.mu.Unlock()
+	if changed && follow {
+		v.scroll.ScrollToBottom()
+	}
+	v.updateVisible()
+}
+
+// SetPlain sets whether a Markdown message is shown as plain text.
+func (v *chatView) SetPlain(id string, plain bool) {
+	v.mu.Lock()
+	if plain {
+		v.plain[id] = true
+	} else {
+		delete(v.plain, id)
+	}
+	v.mu.Unlock()
+	v.Invalidate()
+}
+
+// IsPlain returns true if a Markdown message is shown as plain text.
+func (v *chatView) IsPlain(id string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.plain[id]
+}
+
+// Invalidate lays out all rows again, such as after sender names have changed.
+func (v *chatView) Invalidate() {
+	v.mu.Lock()
+	v.wrapped = make(map[*chatEntry][]string)
+	v.rich = make(map[*chatEntry]*widget.RichText)
+	v.relayout()
+	total := v.offsets[len(v.offsets)-1]
+	follow := v.follow
+	v.mu.Unlock()
+	v.content.Resize(fyne.NewSize(v.scroll.Size().Width, total))
+	if follow {
+		v.scroll.ScrollToBottom()
+	}
+	v.updateVisible()
+}
+
+func (v *chatView) onScrolled(pos fyne.Position) {
+	v.mu.Lock()
+	total := v.offsets[len(v.offsets)-1]
+	// Follow new entries again once the user scrolls back to the bottom.
+	changed := v.setFollow(pos.Y+v.scroll.Size().Height >= total-theme.TextSize())
+	v.mu.Unlock()
+	v.followChanged(changed)
+	v.updateVisible()
+}
+
+// relayout computes the layout of every row, reusing the wrapped lines of entries
+// that are still present. The caller must hold the lock.
+func (v *chatView) relayout() {
+	v.pruneWrapped()
+	v.layoutFrom(0)
+}
+
+// pruneWrapped drops the wrapped lines and rich text of entries that are no longer
+// in the view. The caller must hold the lock.
+func (v *chatView) pruneWrapped() {
+	live := make(map[*chatEntry][]string, len(v.entries))
+	rich := make(map[*chatEntry]*widget.RichText)
+	for _, e := range v.entries {
+		if lines, ok := v.wrapped[e]; ok {
+			live[e] = lines
+		}
+		if rt, ok := v.rich[e]; ok {
+			rich[e] = rt
+		}
+	}
+	v.wrapped, v.rich = live, rich
+}
+
+// layoutFrom computes the layout of the rows from start onwards, keeping the layout
+// of earlier rows. The caller must hold the lock.
+func (v *chatView) layoutFrom(start int) {
+	v.layouts = v.layouts[:start]
+	v.offsets = v.offsets[:start+1]
+	for i := start; i < len(v.entries); i++ {
+		layout := v.layoutRow(i)
+		v.layouts = append(v.layouts, layout)
+		v.offsets = append(v.offsets, v.offsets[i]+layout.height)
+	}
+}
+
+// layoutRow computes the layout of a row. The caller must hold the lock.
+func (v *chatView) layoutRow(i int) chatRowLayout {
+	e := v.entries[i]
+	quote := v.quoteText(e)
+	rich := v.richText(e)
+	lines, ok := v.wrapped[e]
+	if !ok {
+		if rich == nil {
+			lines = wrapText(v.bodyText(e), v.width-theme.Padding()*4, theme.TextSize(), e.textStyle())
+		}
+		if quote != "" {
+			// Quotes are kept to a single line.
+			quoted := wrapText(quote, v.width-theme.Padding()*4, theme.TextSize(), fyne.TextStyle{Italic: true})
+			if len(quoted) > 1 {
+				quoted[0] = strings.TrimRight(quoted[0], " ") + "…"
+			}
+			lines = append(quoted[:1:1], lines...)
+		}
+		v.wrapped[e] = lines
+	}
+	lines = lines[:len(lines):len(lines)]
+	if len(e.reactions) > 0 {
+		lines = append(lines, reactionsText(e.reactions))
+	}
+	if e.replies > 0 && !v.Threaded {
+		lines = append(lines, repliesText(e.replies))
+	}
+	var warning string
+	if e.message != nil && v.Verify != nil {
+		warning = v.Verify(e).warning()
+	}
+	// Messages with a warning always get a header so it can be seen.
+	header := e.message != nil
+	if header && warning == "" && i > 0 {
+		prev := v.entries[i-1]
+		if prev.message != nil && prev.message.From == e.message.From && e.time.Sub(prev.time) < chatGroupWindow {
+			header = false
+		}
+	}
+	layout := chatRowLayout{
+		header:    header,
+		warning:   warning,
+		quote:     quote != "",
+		reactions: len(e.reactions) > 0,
+		replies:   e.replies > 0 && !v.Threaded,
+		lines:     lines,
+		height:    chatRowHeight(header, len(lines)),
+	}
+	if rich != nil {
+		rich.Resize(fyne.NewSize(v.width, rich.Size().Height))
+		layout.rich, layout.richHeight = rich, rich.MinSize().Height
+		layout.height += layout.richHeight
+	}
+	if e.message != nil {
+		if a := e.current().attachmentManifest(); a != nil && a.isImage() && a.Size <= maxAttachmentSize {
+			layout.thumbnail = true
+			layout.height += chatThumbnailSize + theme.Padding()
+		}
+	}
+	return layout
+}
+
+// rowAt returns the index of the row at the given vertical position. The caller must hold the lock.
+func (v *chatView) rowAt(y float32) int {
+	i := sort.Search(len(v.entries), func(i int) bool { return v.offsets[i+1] > y })
+	if i >= len(v.entries) {
+		i = len(v.entries) - 1
+	}
+	return i
+}
+
+// refreshRows refreshes the rows in view, such as after a thumbnail has loaded.
+func (v *chatView) refreshRows() {
+	v.updateVisible()
+}
+
+// updateVisible positions rows for the entries in view and recycles the rest.
+func (v *chatView) updateVisible() {
+	v.mu.Lock()
+	total := v.offsets[len(v.offsets)-1]
+	viewport := v.scroll.Size().Height
+	top := v.scroll.Offset.Y
+	var first, last int
+	if len(v.entries) > 0 {
+		first, last = v.rowAt(top), v.rowAt(top+viewport)
+	} else {
+		first, last = 0, -1
+	}
+	ourID, _ := v.ourID.Get()
+	visible := make(map[*chatEntry]*chatRow, last-first+1)
+	objects := make([]fyne.CanvasObject, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		e := v.entries[i]
+		row, ok := v.visible[e]
+		if ok {
+			delete(v.visible, e)
+		} else if n := len(v.pool); n > 0 {
+			row, v.pool = v.pool[n-1], v.pool[:n-1]
+		} else {
+			row = newChatRow(v)
+		}
+		row.set(e, v.layouts[i], e.message != nil && e.message.From == ourID)
+		row.Move(fyne.NewPos(0, v.offsets[i]))
+		row.Resize(fyne.NewSize(v.width, v.layouts[i].height))
+		visible[e] = row
+		objects = append(objects, row)
+	}
+	for _, row := range v.visible {
+		v.pool = append(v.pool, row)
+	}
+	v.visible = visible
+	atTop := len(v.entries) == 0 || top <= theme.TextSize() || total <= viewport
+	atBottom := top+viewport >= total-theme.TextSize()
+	v.mu.Unlock()
+	v.content.Objects = objects
+	v.content.Refresh()
+	if atTop && v.OnScrolledToTop != nil {
+		v.OnScrolledToTop()
+	}
+	if atBottom && v.OnScrolledToBottom != nil {
+		v.OnScrolledToBottom()
+	}
+}
+
+// chatViewLayout sizes the scrolled content to the total height of the rows. Rows
+// are positioned by the view as it scrolls.
+type chatViewLayout struct {
+	view *chatView
+}
+
+func (l *chatViewLayout) Layout([]fyne.CanvasObject, fyne.Size) {}
+
+func (l *chatViewLayout) MinSize([]fyne.CanvasObject) fyne.Size {
+	l.view.mu.Lock()
+	defer l.view.mu.Unlock()
+	return fyne.NewSize(0, l.view.offsets[len(l.view.offsets)-1])
+}
+
+// chatRow renders a single transcript entry.
+type chatRow struct {
+	widget.BaseWidget
+
+	view    *chatView
+	entry   *chatEntry
+	layout  chatRowLayout
+	own     bool
+	hovered bool
+}
+
+func newChatRow(view *chatView) *chatRow {
+	r := &chatRow{view: view}
+	r.ExtendBaseWidget(r)
+	return r
+}
+
+func (r *chatRow) set(entry *chatEntry, layout chatRowLayout, own bool) {
+	r.entry, r.layout, r.own = entry, layout, own
+	r.Refresh()
+}
+
+// MouseIn shows the sender's node ID in the row header.
+func (r *chatRow) MouseIn(*desktop.MouseEvent) {
+	r.hovered = true
+	r.Refresh()
+}
+
+func (r *chatRow) MouseMoved(*desktop.MouseEvent) {}
+
+// MouseOut restores the row header.
+func (r *chatRow) MouseOut() {
+	r.hovered = false
+	r.Refresh()
+}
+
+// Tapped opens the thread of the row's message if its reply count was tapped, or
+// the reaction picker if its reactions were.
+func (r *chatRow) Tapped(ev *fyne.PointEvent) {
+	if r.entry == nil {
+		return
+	}
+	line := -1
+	for i := range r.layout.lines {
+		if y := r.layout.lineY(i); ev.Position.Y >= y && ev.Position.Y < y+chatLineHeight() {
+			line = i
+			break
+		}
+	}
+	switch {
+	case line == r.layout.repliesLine() && r.view.OpenThread != nil:
+		r.view.OpenThread(r.entry)
+	case line == r.layout.reactionsLine() && r.view.ReactionMenu != nil:
+		menu := r.view.ReactionMenu(r.entry)
+		c := fyne.CurrentApp().Driver().CanvasForObject(r)
+		if menu == nil || c == nil {
+			return
+		}
+		widget.ShowPopUpMenuAtPosition(menu, c, ev.AbsolutePosition)
+	}
+}
+
+// TappedSecondary shows the context menu for the row's entry.
+func (r *chatRow) TappedSecondary(ev *fyne.PointEvent) {
+	if r.entry == nil || r.view.Menu == nil {
+		return
+	}
+	menu := r.view.Menu(r.entry)
+	if menu == nil {
+		return
+	}
+	c := fyne.CurrentApp().Driver().CanvasForObject(r)
+	if c == nil {
+		return
+	}
+	widget.ShowPopUpMenuAtPosition(menu, c, ev.AbsolutePosition)
+}
+
+func (r *chatRow) CreateRenderer() fyne.WidgetRenderer {
+	rr := &chatRowRenderer{
+		row:    r,
+		bg:     canvas.NewRectangle(theme.HoverColor()),
+		avatar: canvas.NewCircle(theme.PrimaryColor()),
+		name:   canvas.NewText("", theme.ForegroundColor()),
+		time:   canvas.NewText("", theme.PlaceHolderColor()),
+		warn:   canvas.NewText("", theme.ErrorColor()),
+		thumb:  canvas.NewImageFromImage(nil),
+	}
+	rr.thumb.FillMode = canvas.ImageFillContain
+	rr.name.TextStyle.Bold = true
+	rr.time.TextSize = theme.CaptionTextSize()
+	rr.warn.TextSize = theme.CaptionTextSize()
+	rr.warn.TextStyle.Bold = true
+	rr.Refresh()
+	return rr
+}
+
+type chatRowRenderer struct {
+	row     *chatRow
+	bg      *canvas.Rectangle
+	avatar  *canvas.Circle
+	name    *canvas.Text
+	time    *canvas.Text
+	warn    *canvas.Text
+	thumb   *canvas.Image
+	lines   []*canvas.Text
+	objects []fyne.CanvasObject
+}
+
+func (r *chatRowRenderer) Layout(size fyne.Size) {
+	r.bg.Resize(size)
+	pad := theme.Padding()
+	lineHeight := chatLineHeight()
+	y := pad
+	if r.row.layout.header {
+		avatarSize := lineHeight - pad
+		r.avatar.Move(fyne.NewPos(pad*2, y+pad/2))
+		r.avatar.Resize(fyne.NewSize(avatarSize, avatarSize))
+		nameX := pad*3 + avatarSize
+		r.name.Move(fyne.NewPos(nameX, y))
+		r.name.Resize(r.name.MinSize())
+		timeSize := r.time.MinSize()
+		r.time.Move(fyne.NewPos(nameX+pad*2+r.name.MinSize().Width, y+lineHeight-timeSize.Height))
+		r.time.Resize(timeSize)
+		r.warn.Move(fyne.NewPos(r.time.Position().X+timeSize.Width+pad*2, r.time.Position().Y))
+		r.warn.Resize(r.warn.MinSize())
+		y += lineHeight
+	}
+	if rich := r.row.layout.rich; rich != nil {
+		rich.Move(fyne.NewPos(0, y+float32(r.row.layout.bodyLine())*lineHeight))
+		rich.Resize(fyne.NewSize(size.Width, r.row.layout.richHeight))
+	}
+	for i, line := range r.lines {
+		x := pad * 2
+		if line.Alignment == fyne.TextAlignCenter {
+			x = (size.Width - line.MinSize().Width) / 2
+		}
+		line.Move(fyne.NewPos(x, r.row.layout.lineY(i)))
+		line.Resize(line.MinSize())
+	}
+	y = r.row.layout.lineY(len(r.lines))
+	if r.row.layout.thumbnail {
+		r.thumb.Move(fyne.NewPos(pad*2, y+pad))
+		r.thumb.Resize(r.thumbnailSize())
+	}
+}
+
+// thumbnailSize returns the size of the thumbnail scaled to fit the reserved space.
+func (r *chatRowRenderer) thumbnailSize() fyne.Size {
+	if r.thumb.Image == nil {
+		return fyne.NewSize(chatThumbnailSize, chatThumbnailSize)
+	}
+	b := r.thumb.Image.Bounds()
+	if b.Dy() == 0 {
+		return fyne.NewSize(0, 0)
+	}
+	w := float32(b.Dx()) * chatThumbnailSize / float32(b.Dy())
+	if avail := r.row.Size().Width - theme.Padding()*4; w > avail && avail > 0 {
+		return fyne.NewSize(avail, chatThumbnailSize)
+	}
+	return fyne.NewSize(w, chatThumbnailSize)
+}
+
+func (r *chatRowRenderer) MinSize() fyne.Size {
+	return fyne.NewSize(0, r.row.layout.height)
+}
+
+func (r *chatRowRenderer) Refresh() {
+	entry, layout := r.row.entry, r.row.layout
+	r.bg.FillColor = theme.HoverColor()
+	r.bg.Hidden = !r.row.own
+	r.avatar.Hidden = !layout.header
+	r.name.Hidden = !layout.header
+	r.time.Hidden = !layout.header
+	r.warn.Hidden = !layout.header || layout.warning == ""
+	r.warn.Text = layout.warning
+	r.warn.Color = theme.ErrorColor()
+	if entry != nil && entry.message != nil {
+		from := entry.message.From
+		name, flagged := r.row.view.profiles.name(from)
+		r.avatar.FillColor = r.row.view.profiles.color(from)
+		r.name.Text = name
+		switch {
+		case flagged:
+			r.name.Color = theme.WarningColor()
+		case r.row.own:
+			r.name.Color = theme.PrimaryColor()
+		default:
+			r.name.Color = theme.ForegroundColor()
+		}
+		r.time.Text = chatTimeString(entry.time)
+		if r.row.hovered && name != from {
+			r.time.Text = from + " · " + r.time.Text
+		}
+		r.time.Color = theme.PlaceHolderColor()
+	}
+	for len(r.lines) < len(layout.lines) {
+		r.lines = append(r.lines, canvas.NewText("", theme.ForegroundColor()))
+	}
+	r.lines = r.lines[:len(layout.lines)]
+	for i, text := range layout.lines {
+		line := r.lines[i]
+		line.Text = text
+		line.Color = theme.ForegroundColor()
+		line.Alignment = fyne.TextAlignLeading
+		if entry != nil {
+			line.TextStyle = entry.textStyle()
+			if entry.message == nil || entry.deleted() {
+				line.Color = theme.PlaceHolderColor()
+			}
+			if entry.message == nil {
+				line.Alignment = fyne.TextAlignCenter
+			}
+		}
+		switch i {
+		case layout.quoteLine():
+			line.TextStyle = fyne.TextStyle{Italic: true}
+			line.Color = theme.PlaceHolderColor()
+		case layout.reactionsLine():
+			line.TextStyle = fyne.TextStyle{}
+			line.Color = theme.ForegroundColor()
+		case layout.repliesLine():
+			line.TextStyle = fyne.TextStyle{Bold: true}
+			line.Color = theme.PrimaryColor()
+		}
+	}
+	r.thumb.Hidden = !layout.thumbnail
+	if layout.thumbnail && r.row.view.Thumbnail != nil {
+		if img := r.row.view.Thumbnail(entry); img != r.thumb.Image {
+			r.thumb.Image = img
+			r.thumb.Refresh()
+		}
+	} else {
+		r.thumb.Image = nil
+	}
+	r.objects = []fyne.CanvasObject{r.bg, r.avatar, r.name, r.time, r.warn, r.thumb}
+	if layout.rich != nil {
+		r.objects = append(r.objects, layout.rich)
+	}
+	for _, line := range r.lines {
+		r.objects = append(r.objects, line)
+	}
+	r.Layout(r.row.Size())
+	canvas.Refresh(r.row)
+}
+
+func (r *chatRowRenderer) Objects() []fyne.CanvasObject {
+	return r.objects
+}
+
+func (r *chatRowRenderer) Destroy() {}
+
+// bodyText returns the text displayed in the body of an entry's row.
+func (v *chatView) bodyText(e *chatEntry) string {
+	if e.message != nil {
+		if e.edited() {
+			return e.current().displayText() + " (edited)"
+		}
+		return e.current().displayText()
+	}
+	if e.member != "" {
+		name, _ := v.profiles.name(e.member)
+		return name + " " + e.event
+	}
+	return e.event
+}
+
+// richText returns the rendered body of a Markdown entry, or nil if it is shown as
+// plain text. The caller must hold the lock.
+func (v *chatView) richText(e *chatEntry) *widget.RichText {
+	if e.message == nil || e.deleted() || e.current().ContentType != ContentTypeMarkdown || v.plain[e.message.ID] {
+		return nil
+	}
+	if rt, ok := v.rich[e]; ok {
+		return rt
+	}
+	rt := newMarkdownText(e.current().Body, v.CopyText)
+	if e.edited() {
+		rt.Segments = append(rt.Segments, &widget.TextSegment{
+			Style: widget.RichTextStyle{ColorName: theme.ColorNamePlaceHolder, TextStyle: fyne.TextStyle{Italic: true}},
+			Text:  "(edited)",
+		})
+	}
+	v.rich[e] = rt
+	return rt
+}
+
+// quoteText returns the quote shown above a reply, or an empty string for none.
+func (v *chatView) quoteText(e *chatEntry) string {
+	if v.Threaded || e.message == nil || e.message.Reply == nil || e.message.Reply.Excerpt == "" {
+		return ""
+	}
+	name, _ := v.profiles.name(e.message.Reply.From)
+	return "> " + name + ": " + e.message.Reply.Excerpt
+}
+
+// repliesText returns the reply count shown below the message that started a thread.
+func repliesText(n int) string {
+	if n == 1 {
+		return "1 reply"
+	}
+	return fmt.Sprintf("%d replies", n)
+}
+
+// textStyle returns the style of the body text of the entry's row.
+func (e *chatEntry) textStyle() fyne.TextStyle {
+	if e.message == nil || e.deleted() {
+		return fyne.TextStyle{Italic: true}
+	}
+	return fyne.TextStyle{}
+}
+
+// chatLineHeight returns the height of a single line of chat text.
+func chatLineHeight() float32 {
+	return fyne.MeasureText("Mg", theme.TextSize(), fyne.TextStyle{}).Height
+}
+
+// chatRowHeight returns the height of a row with the given number of body lines.
+func chatRowHeight(header bool, lines int) float32 {
+	n := lines
+	if header {
+		n++
+	}
+	return theme.Padding()*2 + float32(n)*chatLineHeight()
+}
+
+// chatTimeString formats a message time for a row header.
+func chatTimeString(t time.Time) string {
+	t = t.Local()
+	now := time.Now()
+	if t.Year() == now.Year() && t.YearDay() == now.YearDay() {
+		return t.Format("15:04")
+	}
+	return t.Format("Jan 2 15:04")
+}
+
+// wrapText word wraps text to fit the given width, breaking words that are too
+// long to fit on a line by themselves.
+func wrapText(text string, width, size float32, style fyne.TextStyle) []string {
+	if width <= 0 {
+		// Not laid out yet.
+		return strings.Split(text, "\n")
+	}
+	fits := func(s string) bool {
+		return fyne.MeasureText(s, size, style).Width <= width
+	}
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		var line string
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if fits(candidate) {
+				line = candidate
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+			line = word
+			for line != "" && !fits(line) {
+				runes := []rune(line)
+				// Find the longest prefix that fits, always taking at least one rune.
+				n := sort.Search(len(runes), func(i int) bool { return !fits(string(runes[:i+1])) })
+				if n == 0 {
+					n = 1
+				}
+				lines = append(lines, string(runes[:n]))
+				line = string(runes[n:])
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"testing"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/test"
+)
+
+// newTestChatView returns a chat view laid out in a test window, counting the rows
+// it lays out by how often it verifies a sender.
+func newTestChatView(t testing.TB) (*chatView, *int) {
+	test.NewApp()
+	v := newChatView(binding.NewString(), newProfileDirectory())
+	var layouts int
+	v.Verify = func(*chatEntry) verifyStatus {
+		layouts++
+		return verifyOK
+	}
+	w := test.NewWindow(v)
+	w.Resize(fyne.NewSize(480, 640))
+	t.Cleanup(w.Close)
+	return v, &layouts
+}
+
+func TestChatViewKeepsLayoutsWhenTrimmed(t *testing.T) {
+	v, layouts := newTestChatView(t)
+	tr := fillTranscript("room", chatTranscriptWindow)
+	v.SetEntries(tr.snapshot())
+	tr.insert(newTestEntry("room", chatTranscriptWindow))
+	*layouts = 0
+	v.SetEntries(tr.snapshot())
+	// Only the new row and the row now at the top, which lost its neighbour above,
+	// are laid out again.
+	if *layouts != 2 {
+		t.Errorf("expected 2 rows laid out, got %d", *layouts)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var total float32
+	for i, l := range v.layouts {
+		if v.offsets[i] != total {
+			t.Fatalf("row %d is at %v, expected %v", i, v.offsets[i], total)
+		}
+		total += l.height
+	}
+	if !v.layouts[0].header {
+		t.Error("expected the first row to have a header")
+	}
+}
+
+// BenchmarkChatViewAppend measures showing a live message in rooms with increasing
+// history. The cost should not grow with the size of the room.
+func BenchmarkChatViewAppend(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("messages=%d", n), func(b *testing.B) {
+			v, _ := newTestChatView(b)
+			tr := fillTranscript("bench", n)
+			v.SetEntries(tr.snapshot())
+			entries := make([]*chatEntry, b.N)
+			for i := range entries {
+				entries[i] = newTestEntry("bench", n+i)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for _, e := range entries {
+				tr.insert(e)
+				v.SetEntries(tr.snapshot())
+			}
+		})
+	}
+}
@@ -33,12 +33,28 @@ var (
 	connectedInterface = binding.NewString()
 	totalSentBytes     = binding.NewString()
 	totalRecvBytes     = binding.NewString()
+	sendRate           = binding.NewString()
+	recvRate           = binding.NewString()
 )
 
-func resetConnectedValues() {
+func (app *App) resetConnectedValues() {
 	connectedInterface.Set("---")
 	totalSentBytes.Set("---")
 	totalRecvBytes.Set("---")
+	sendRate.Set("---")
+	recvRate.Set("---")
+	nodeAddressV4.Set("---")
+	nodeAddressV6.Set("---")
+	nodePublicKey.Set("---")
+	nodeListenPort.Set("---")
+	app.throughput.reset()
+	app.throughputGraph.Clear()
+	app.peers.update(nil)
+	app.metrics.iface.Store(nil)
+	if app.history != nil {
+		app.history.resetBaseline()
+	}
+	app.quotas.resetBaseline()
 }
 
 // onConnectChange fires when the value of the connected switch changes.
@@ -79,13 +95,17 @@ func (app *App) onConnectChange(label binding.String, switchValue binding.Float)
 					switchValue.Set(switchDisconnected)
 					return
 				}
+				if app.connectedBefore.Swap(true) {
+					app.metrics.reconnects.Inc()
+				}
 				switchValue.Set(switchConnected)
 				app.newPSKButton.Enable()
 				app.connected.Store(true)
 				nodeFQDN := fmt.Sprintf("%s.%s", resp.GetNodeId(), resp.GetMeshDomain())
 				app.nodeID.Set(resp.GetNodeId())
+				app.Preferences().SetString(preferenceLastNodeID, resp.GetNodeId())
 				app.nodeIDDisplay.Set(fmt.Sprintf("Connected as %q", nodeFQDN))
-				app.chatContainer.Show()
+				app.showOnline()
 			}()
 		case switchConnected:
 			label.Set("Connected")
@@ -113,16 +133,37 @@ func (app *App) onConnectChange(label binding.String, switchValue binding.Float)
 								return
 							}
 							app.log.Error("error receiving room", "error", err.Error())
+							app.metrics.subscriptionErrors.WithLabelValues("rooms").Inc()
 							return
 						}
 						prefix := strings.TrimPrefix(resp.GetKey(), RoomsPrefix+"/")
 						parts := strings.Split(prefix, "/")
-						if len(parts) == 1 {
+						if len(parts) == 1 && !isDirectRoom(parts[0]) {
+							info, err := DecodeRoomInfo(resp.GetValue())
+							if err != nil {
+								app.log.Error("error decoding room info", "room", parts[0], "error", err.Error())
+							} else {
+								app.setRoomInfo(parts[0], info)
+							}
 							app.roomsList.Append(parts[0])
+						} else if len(parts) == 4 && parts[1] == "messages" {
+							app.onRoomActivity(parts[0], resp.GetKey(), resp.GetValue())
 						}
 					}
 				}()
 			}
+			// Publish our profile and watch for the profiles of others.
+			if c != nil {
+				go app.watchProfiles(ctx, v1.NewAppDaemonClient(c))
+				go app.watchDirectInvites(ctx, v1.NewAppDaemonClient(c))
+				go app.indexJoinedRooms(ctx, v1.NewAppDaemonClient(c))
+			}
+			go app.refreshMemberships(ctx)
+			go app.runPresenceHeartbeats(ctx)
+			app.refreshDirectList()
+			if err := app.publishProfile(ctx); err != nil {
+				app.log.Error("error publishing profile", "error", err.Error())
+			}
 			// Try to fetch the current list of rooms.
 			rooms, err := app.listRooms()
 			if err != nil {
@@ -135,29 +176,12 @@ func (app *App) onConnectChange(label binding.String, switchValue binding.Float)
 				app.log.Error("error getting interface metrics", "error", err.Error())
 			} else {
 				connectedInterface.Set(metrics.DeviceName)
+				app.updateInterfaceMetrics(metrics)
 			}
-
-			go func() {
-				t := time.NewTicker(time.Second * 5)
-				defer t.Stop()
-				for {
-					select {
-					case <-ctx.Done():
-						return
-					case <-t.C:
-						metrics, err := app.getNodeMetrics(ctx)
-						if err != nil {
-							app.log.Error("error getting interface metrics", "error", err.Error())
-							continue
-						}
-						totalSentBytes.Set(bytesString(int(metrics.TotalTransmitBytes)))
-						totalRecvBytes.Set(bytesString(int(metrics.TotalReceiveBytes)))
-					}
-				}
-			}()
+			go app.pollMetrics(ctx)
 		case switchDisconnected:
 			// Disconnect from the mesh.
-			defer resetConnectedValues()
+			defer app.resetConnectedValues()
 			defer app.cancelNodeSubscriptions()
 			if app.connecting.Load() {
 				app.log.Info("cancelling in-progress connection")
@@ -185,13 +209,57 @@ func (app *App) onConnectChange(label binding.String, switchValue binding.Float)
 				app.nodeID.Set("")
 				app.nodeIDDisplay.Set("")
 				app.chatContainer.Hide()
-				app.chatText.SetText("")
+				app.chatView.Clear()
+				app.profiles.reset()
 				app.roomsList.Set([]string{})
+				app.directList.Set([]string{})
+				app.unread.clear("")
+				app.showOffline()
 			}()
 		}
 	}
 }
 
+// updateInterfaceMetrics updates the displayed interface metrics from a new sample.
+func (app *App) updateInterfaceMetrics(metrics *v1.InterfaceMetrics) {
+	app.metrics.iface.Store(metrics)
+	if app.history != nil {
+		if _, _, err := app.history.record(time.Now(), metrics); err != nil {
+			app.log.Error("error recording metrics history", "error", err.Error())
+		}
+	}
+	nodeAddressV4.Set(metrics.GetAddressV4())
+	nodeAddressV6.Set(metrics.GetAddressV6())
+	nodePublicKey.Set(metrics.GetPublicKey())
+	nodeListenPort.Set(strconv.Itoa(int(metrics.GetListenPort())))
+	totalSentBytes.Set(bytesString(int(metrics.TotalTransmitBytes)))
+	totalRecvBytes.Set(bytesString(int(metrics.TotalReceiveBytes)))
+	if sample, ok := app.throughput.observe(time.Now(), metrics); ok {
+		sendRate.Set(rateString(sample.sendRate))
+		recvRate.Set(rateString(sample.recvRate))
+	}
+	app.refreshThroughputGraph()
+	app.peers.update(metrics.GetPeers())
+	app.checkQuotas(metrics)
+}
+
+// refreshThroughputGraph redraws the throughput graph for the selected window.
+func (app *App) refreshThroughputGraph() {
+	window := time.Duration(app.throughputWindow.Load())
+	samples := app.throughput.window(window)
+	times := make([]time.Time, len(samples))
+	sent := make([]float64, len(samples))
+	recv := make([]float64, len(samples))
+	for i, s := range samples {
+		times[i] = s.time
+		sent[i] = s.sendRate
+		recv[i] = s.recvRate
+	}
+	app.throughputGraph.SetWindow(window)
+	app.throughputGraph.SetSeries(0, times, sent)
+	app.throughputGraph.SetSeries(1, times, recv)
+}
+
 func bytesString(n int) string {
 	if n < 1024 {
 		return strconv.Itoa(n) + " B"
@@ -202,3 +270,7 @@ func bytesString(n int) string {
 	}
 	return strconv.Itoa(n/1024/1024/1024) + " GB"
 }
+
+func rateString(n float64) string {
+	return bytesString(int(n)) + "/s"
+}
@@ -0,0 +1,587 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	v1 "github.com/webmeshproj/api/v1"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// InvitesPrefix is the prefix for direct message invites.
+	InvitesPrefix = ChatPrefix + "/invites"
+	// directRoomPrefix prefixes the names of direct message rooms.
+	directRoomPrefix = "@"
+	// preferenceDirectKey is the preference holding our X25519 key for direct messages.
+	preferenceDirectKey = "directKey"
+	// preferenceDirectPeers is the preference holding the nodes we have direct messages with.
+	preferenceDirectPeers = "directPeers"
+	// directInviteVersion is the current direct message invite format version.
+	directInviteVersion = 1
+	// directInviteTTL is how long a direct message invite is kept in the mesh.
+	directInviteTTL = 7 * 24 * time.Hour
+	// maxPendingInvites is the most invites held from nodes whose profiles we have not seen.
+	maxPendingInvites = 64
+)
+
+// InvitePath returns the storage path of an invite to a direct message with a node.
+// The ID is random so that the path does not reveal who sent the invite.
+func InvitePath(to, id string) string {
+	return path.Join(InvitesPrefix, to, id)
+}
+
+// directInvite is the value of a direct message invite. The sender is sealed to the
+// direct message key of the invited node with an ephemeral key, so only the invited
+// node learns who sent it.
+type directInvite struct {
+	// Version is the invite format version.
+	Version int `json:"v"`
+	// Ephemeral is the X25519 public key the invite is sealed with.
+	Ephemeral []byte `json:"eph"`
+	// Sealed is the sealed inviteSender.
+	Sealed string `json:"sealed"`
+}
+
+// inviteSender is the sealed content of a direct message invite.
+type inviteSender struct {
+	// From is the ID of the node that sent the invite.
+	From string `json:"from"`
+	// Signature is the sender's Ed25519 signature over the invite path and sender.
+	Signature []byte `json:"sig"`
+}
+
+// invitePayload returns the bytes a node signs to invite another to direct messages.
+func invitePayload(invitePath, from string) []byte {
+	return []byte("webmesh direct invite\x00" + invitePath + "\x00" + from)
+}
+
+// inviteKey derives the key an invite is sealed with from an X25519 shared secret.
+func inviteKey(secret, ephemeral []byte) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, secret, ephemeral, []byte("webmesh direct invite"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, fmt.Errorf("failed to derive invite key: %w", err)
+	}
+	return key, nil
+}
+
+// newDirectInvite returns the path and value of an invite to direct messages with a
+// node, sealed to its direct message key and signed with our signing key.
+func (app *App) newDirectInvite(peerID string) (string, string, error) {
+	peerKey, err := app.peerDirectKey(peerID)
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid direct message key: %w", err)
+	}
+	signingKey, err := app.signingKey()
+	if err != nil {
+		return "", "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate invite key: %w", err)
+	}
+	secret, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	key, err := inviteKey(secret, ephemeral.PublicKey().Bytes())
+	if err != nil {
+		return "", "", err
+	}
+	ourID, _ := app.nodeID.Get()
+	invitePath := InvitePath(peerID, hex.EncodeToString(id))
+	sender, err := json.Marshal(&inviteSender{
+		From:      ourID,
+		Signature: ed25519.Sign(signingKey, invitePayload(invitePath, ourID)),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode invite: %w", err)
+	}
+	sealed, err := sealRoomValue(key, sender, invitePath)
+	if err != nil {
+		return "", "", err
+	}
+	value, err := json.Marshal(&directInvite{Version: directInviteVersion, Ephemeral: ephemeral.PublicKey().Bytes(), Sealed: sealed})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode invite: %w", err)
+	}
+	return invitePath, string(value), nil
+}
+
+// openDirectInvite returns the sender of an invite published to us.
+func (app *App) openDirectInvite(invitePath, value string) (*inviteSender, error) {
+	var invite directInvite
+	if err := json.Unmarshal([]byte(value), &invite); err != nil {
+		return nil, fmt.Errorf("failed to decode invite: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(invite.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite key: %w", err)
+	}
+	ours, err := app.directKey()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ours.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	key, err := inviteKey(secret, invite.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openRoomValue(key, invite.Sealed, invitePath)
+	if err != nil {
+		return nil, err
+	}
+	var sender inviteSender
+	if err := json.Unmarshal(data, &sender); err != nil {
+		return nil, fmt.Errorf("failed to decode invite: %w", err)
+	}
+	if sender.From == "" || strings.ContainsAny(sender.From, "/,") {
+		return nil, errors.New("invalid invite sender")
+	}
+	return &sender, nil
+}
+
+// pendingInvites holds the invites from nodes whose signing key we do not have yet,
+// until their profiles arrive.
+type pendingInvites struct {
+	mu      sync.Mutex
+	invites map[string]pendingInvite
+}
+
+// pendingInvite is an invite waiting for the sender's signing key.
+type pendingInvite struct {
+	path      string
+	signature []byte
+}
+
+// add holds an invite from a node.
+func (p *pendingInvites) add(from, invitePath string, sig []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.invites == nil {
+		p.invites = make(map[string]pendingInvite)
+	}
+	if _, ok := p.invites[from]; !ok && len(p.invites) >= maxPendingInvites {
+		return
+	}
+	p.invites[from] = pendingInvite{path: invitePath, signature: sig}
+}
+
+// take removes and returns the invite held from a node.
+func (p *pendingInvites) take(from string) (pendingInvite, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	invite, ok := p.invites[from]
+	delete(p.invites, from)
+	return invite, ok
+}
+
+// DirectRoomName returns the name of the room for direct messages between two nodes.
+// It is the same for both nodes and does not reveal who they are.
+func DirectRoomName(a, b string) string {
+	ids := []string{a, b}
+	sort.Strings(ids)
+	sum := sha256.Sum256([]byte(ids[0] + "\x00" + ids[1]))
+	return directRoomPrefix + hex.EncodeToString(sum[:16])
+}
+
+// isDirectRoom returns true if the room holds direct messages.
+func isDirectRoom(roomName string) bool {
+	return strings.HasPrefix(roomName, directRoomPrefix)
+}
+
+// directKey returns our X25519 key for direct messages, creating it on first use.
+func (app *App) directKey() (*ecdh.PrivateKey, error) {
+	app.keys.mu.Lock()
+	defer app.keys.mu.Unlock()
+	if app.keys.direct != nil {
+		return app.keys.direct, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(app.Preferences().String(preferenceDirectKey))
+	if err == nil && len(data) > 0 {
+		if key, err := ecdh.X25519().NewPrivateKey(data); err == nil {
+			app.keys.direct = key
+			return key, nil
+		}
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate direct message key: %w", err)
+	}
+	app.Preferences().SetString(preferenceDirectKey, base64.StdEncoding.EncodeToString(key.Bytes()))
+	app.keys.direct = key
+	return key, nil
+}
+
+// directKeyPayload returns the bytes a node signs to publish its direct message key.
+func directKeyPayload(nodeID string, key []byte) []byte {
+	return append([]byte("webmesh direct key\x00"+nodeID+"\x00"), key...)
+}
+
+// peerDirectKey returns the direct message key a node published in its profile. The
+// key is only used if it is signed with the signing key pinned for the node, so that
+// republishing the profile cannot redirect direct messages.
+func (app *App) peerDirectKey(peerID string) ([]byte, error) {
+	key, sig := app.profiles.directKey(peerID)
+	if key == nil {
+		return nil, fmt.Errorf("%s has not published a direct message key", peerID)
+	}
+	pinned := app.pinnedKey(peerID)
+	if pinned == nil || !ed25519.Verify(pinned, directKeyPayload(peerID, key), sig) {
+		return nil, fmt.Errorf("direct message key of %s is not signed with its pinned key", peerID)
+	}
+	return key, nil
+}
+
+// deriveDirectKey derives the key of the direct message room with a node from our key
+// and the key the node published in its profile.
+func (app *App) deriveDirectKey(peerID string) ([]byte, error) {
+	peerKey, err := app.peerDirectKey(peerID)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid direct message key: %w", err)
+	}
+	ours, err := app.directKey()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ours.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	ourID, _ := app.nodeID.Get()
+	key := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, secret, []byte(DirectRoomName(ourID, peerID)), []byte("webmesh direct message"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, fmt.Errorf("failed to derive direct message key: %w", err)
+	}
+	return key, nil
+}
+
+// directPeers returns the nodes we have direct messages with.
+func (app *App) directPeers() []string {
+	return app.preferenceList(preferenceDirectPeers)
+}
+
+// addDirectPeer adds a node to the direct message list.
+func (app *App) addDirectPeer(peerID string) {
+	peers := app.directPeers()
+	if !slices.Contains(peers, peerID) {
+		peers = append(peers, peerID)
+		app.setPreferenceList(preferenceDirectPeers, peers)
+	}
+	app.refreshDirectList()
+}
+
+// removeDirectPeer removes a node from the direct message list.
+func (app *App) removeDirectPeer(peerID string) {
+	peers := slices.DeleteFunc(app.directPeers(), func(id string) bool { return id == peerID })
+	app.setPreferenceList(preferenceDirectPeers, peers)
+	app.refreshDirectList()
+}
+
+// refreshDirectList updates the direct message list from the saved peers.
+func (app *App) refreshDirectList() {
+	peers := app.directPeers()
+	app.profiles.sortByName(peers)
+	app.directList.Set(peers)
+}
+
+// directPeerForRoom returns the node a direct message room is with, or an empty
+// string if it is not one of ours.
+func (app *App) directPeerForRoom(roomName string) string {
+	ourID, _ := app.nodeID.Get()
+	for _, peerID := range app.directPeers() {
+		if DirectRoomName(ourID, peerID) == roomName {
+			return peerID
+		}
+	}
+	return ""
+}
+
+// unlockDirectRoom derives and stores the key of the direct message room with a node.
+func (app *App) unlockDirectRoom(peerID string) error {
+	ourID, _ := app.nodeID.Get()
+	roomName := DirectRoomName(ourID, peerID)
+	key, err := app.deriveDirectKey(peerID)
+	if err != nil {
+		return err
+	}
+	if info := app.rooms.info(roomName); info != nil && info.Check != "" {
+		if err := checkRoomKey(roomName, info, key); err != nil {
+			return fmt.Errorf("direct message key does not match: %w", err)
+		}
+	}
+	app.setRoomKey(roomName, key)
+	return nil
+}
+
+// startDirectMessage creates the direct message room with a node if needed, invites
+// the node to it and opens it.
+func (app *App) startDirectMessage(peerID string) {
+	ourID, _ := app.nodeID.Get()
+	if peerID == "" || peerID == ourID {
+		dialog.ShowError(errors.New("choose another node to message"), app.main)
+		return
+	}
+	roomName := DirectRoomName(ourID, peerID)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if app.rooms.info(roomName) == nil {
+		app.refreshRoomInfo(roomName)
+	}
+	if app.rooms.info(roomName) == nil {
+		key, err := app.deriveDirectKey(peerID)
+		if err != nil {
+			dialog.ShowError(err, app.main)
+			return
+		}
+		check, err := sealRoomValue(key, []byte(roomKeyCheck), RoomPath(roomName))
+		if err != nil {
+			dialog.ShowError(err, app.main)
+			return
+		}
+		info := &RoomInfo{Version: RoomInfoVersion, Encrypted: true, Direct: true, Check: check}
+		value, err := info.Encode()
+		if err != nil {
+			dialog.ShowError(err, app.main)
+			return
+		}
+		err = app.doPublish(ctx, &v1.PublishRequest{Key: RoomPath(roomName), Value: value})
+		if err != nil {
+			app.log.Error("error creating direct message room", "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
+		app.forgetRoom(roomName)
+		app.setRoomInfo(roomName, info)
+		app.setRoomKey(roomName, key)
+	} else if err := app.unlockDirectRoom(peerID); err != nil {
+		dialog.ShowError(err, app.main)
+		return
+	}
+	invitePath, invite, err := app.newDirectInvite(peerID)
+	if err != nil {
+		app.log.Error("error creating direct message invite", "error", err.Error())
+		dialog.ShowError(err, app.main)
+		return
+	}
+	err = app.doPublish(ctx, &v1.PublishRequest{
+		Key:   invitePath,
+		Value: invite,
+		Ttl:   durationpb.New(directInviteTTL),
+	})
+	if err != nil {
+		app.log.Error("error inviting node to direct message", "error", err.Error())
+		dialog.ShowError(err, app.main)
+		return
+	}
+	app.addDirectPeer(peerID)
+	peers, _ := app.directList.Get()
+	if i := slices.Index(peers, peerID); i >= 0 {
+		app.directListWidget.Select(i)
+	}
+}
+
+// onNewDirectMessage asks for a node to start a direct message with.
+func (app *App) onNewDirectMessage() {
+	if app.chatContainer.Hidden {
+		return
+	}
+	ourID, _ := app.nodeID.Get()
+	known := app.profiles.nodeIDs()
+	members, _ := app.chatMembers.Get()
+	for _, id := range members {
+		if !slices.Contains(known, id) {
+			known = append(known, id)
+		}
+	}
+	known = slices.DeleteFunc(known, func(id string) bool { return id == ourID })
+	app.profiles.sortByName(known)
+	options := make([]string, len(known))
+	for i, id := range known {
+		name, _ := app.profiles.name(id)
+		options[i] = name
+	}
+	nodeSelect := widget.NewSelectEntry(options)
+	nodeSelect.SetPlaceHolder("Display name or node ID")
+	dialog.ShowForm("New Direct Message", "Start", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Node", nodeSelect),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		peerID := strings.TrimSpace(nodeSelect.Text)
+		if i := slices.Index(options, peerID); i >= 0 {
+			peerID = known[i]
+		}
+		go app.startDirectMessage(peerID)
+	}, app.main)
+}
+
+// watchDirectInvites adds the nodes that invite us to direct messages to the direct
+// message list until the context is cancelled.
+func (app *App) watchDirectInvites(ctx context.Context, cli v1.AppDaemonClient) {
+	ourID, _ := app.nodeID.Get()
+	prefix := path.Join(InvitesPrefix, ourID)
+	stream, err := cli.Subscribe(ctx, &v1.SubscribeRequest{Prefix: prefix})
+	if err != nil {
+		app.log.Error("error subscribing to direct message invites", "error", err.Error())
+		return
+	}
+	defer stream.CloseSend()
+	keys, err := queryKeys(ctx, cli, prefix)
+	if err != nil {
+		app.log.Error("error listing direct message invites", "error", err.Error())
+	}
+	for _, key := range keys {
+		value, err := queryValue(ctx, cli, key)
+		if err != nil {
+			app.log.Error("error fetching direct message invite", "error", err.Error())
+			continue
+		}
+		app.onDirectInvite(prefix, key, value)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return
+			}
+			app.log.Error("error receiving direct message invite", "error", err.Error())
+			app.metrics.subscriptionErrors.WithLabelValues("invites").Inc()
+			return
+		}
+		app.onDirectInvite(prefix, resp.GetKey(), resp.GetValue())
+	}
+}
+
+// onDirectInvite adds the node that sent an invite to the direct message list once
+// the invite is signed with the node's pinned key.
+func (app *App) onDirectInvite(prefix, key, value string) {
+	if id := strings.TrimPrefix(key, prefix+"/"); id == key || id == "" || strings.Contains(id, "/") {
+		return
+	}
+	sender, err := app.openDirectInvite(key, value)
+	if err != nil {
+		app.log.Warn("ignoring direct message invite", "key", key, "error", err.Error())
+		return
+	}
+	if app.pinnedKey(sender.From) == nil {
+		app.invites.add(sender.From, key, sender.Signature)
+		return
+	}
+	app.acceptDirectInvite(sender.From, key, sender.Signature)
+}
+
+// onInviterProfile accepts an invite held until the sender's profile arrived.
+func (app *App) onInviterProfile(nodeID string) {
+	if invite, ok := app.invites.take(nodeID); ok {
+		app.acceptDirectInvite(nodeID, invite.path, invite.signature)
+	}
+}
+
+// acceptDirectInvite adds the sender of an invite to the direct message list if the
+// invite is signed with the sender's pinned key.
+func (app *App) acceptDirectInvite(from, invitePath string, sig []byte) {
+	pinned := app.pinnedKey(from)
+	if pinned == nil || !ed25519.Verify(pinned, invitePayload(invitePath, from), sig) {
+		app.log.Warn("ignoring direct message invite with invalid signature", "node", from)
+		return
+	}
+	app.addDirectPeer(from)
+}
+
+// onDirectSelected opens the direct message room with the selected node.
+func (app *App) onDirectSelected(index int) {
+	if app.chatContainer.Hidden {
+		return
+	}
+	app.roomsListWidget.UnselectAll()
+	peerID, err := app.directList.GetValue(index)
+	if err != nil {
+		app.log.Error("error getting direct message peer", "error", err.Error())
+		return
+	}
+	ourID, _ := app.nodeID.Get()
+	roomName := DirectRoomName(ourID, peerID)
+	if app.rooms.info(roomName) == nil && app.connected.Load() {
+		app.refreshRoomInfo(roomName)
+	}
+	if app.rooms.locked(roomName) {
+		if err := app.unlockDirectRoom(peerID); err != nil {
+			dialog.ShowError(err, app.main)
+			app.directListWidget.UnselectAll()
+			return
+		}
+	}
+	app.openRoom(roomName)
+}
+
+// newDirectListWidget returns the list of direct message conversations.
+func (app *App) newDirectListWidget() *widget.List {
+	list := widget.NewListWithData(app.directList,
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(item binding.DataItem, obj fyne.CanvasObject) {
+			peerID, _ := item.(binding.String).Get()
+			name, _ := app.profiles.name(peerID)
+			ourID, _ := app.nodeID.Get()
+			obj.(*widget.Label).SetText(truncate(name, 24) + app.unread.badge(DirectRoomName(ourID, peerID)))
+		},
+	)
+	list.OnSelected = app.onDirectSelected
+	list.OnUnselected = app.onRoomUnselected
+	return list
+}
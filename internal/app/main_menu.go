@@ -23,6 +23,7 @@ func (app *App) newMainMenu() *fyne.MainMenu {
 	menu := fyne.NewMainMenu(
 		fyne.NewMenu("File",
 			fyne.NewMenuItem("Preferences", app.displayPreferences),
+			fyne.NewMenuItem("Export Metrics…", app.onExportMetrics),
 		),
 	)
 	return menu
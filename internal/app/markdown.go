@@ -0,0 +1,137 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/url"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	// ContentTypeMarkdown is the content type for messages formatted with Markdown.
+	ContentTypeMarkdown = "text/markdown"
+
+	// preferenceMarkdown is the preference for sending messages formatted with Markdown.
+	preferenceMarkdown = "markdown"
+)
+
+// newMarkdownText returns rich text rendering a Markdown message. Code blocks get a
+// button that copies them with copyText, and images are shown as links rather than
+// fetched.
+func newMarkdownText(body string, copyText func(string)) *widget.RichText {
+	rt := widget.NewRichTextFromMarkdown(body)
+	rt.Segments = rewriteSegments(rt.Segments, copyText)
+	rt.Wrapping = fyne.TextWrapWord
+	return rt
+}
+
+// rewriteSegments replaces the code blocks and images in parsed Markdown.
+func rewriteSegments(segs []widget.RichTextSegment, copyText func(string)) []widget.RichTextSegment {
+	for i, seg := range segs {
+		switch s := seg.(type) {
+		case *widget.TextSegment:
+			if s.Style == widget.RichTextStyleCodeBlock {
+				segs[i] = &codeBlockSegment{text: s.Text, copyText: copyText}
+			}
+		case *widget.ImageSegment:
+			link := &widget.HyperlinkSegment{Text: s.Source.String()}
+			if s.Title != "" {
+				link.Text = s.Title
+			}
+			link.URL, _ = url.Parse(s.Source.String())
+			segs[i] = link
+		case *widget.ParagraphSegment:
+			s.Texts = rewriteSegments(s.Texts, copyText)
+		case *widget.ListSegment:
+			s.Items = rewriteSegments(s.Items, copyText)
+		}
+	}
+	return segs
+}
+
+// codeBlockSegment is a rich text segment showing a block of code in a monospaced
+// font with a button to copy it. Long lines scroll rather than wrap.
+type codeBlockSegment struct {
+	text     string
+	copyText func(string)
+}
+
+func (c *codeBlockSegment) Inline() bool {
+	return false
+}
+
+func (c *codeBlockSegment) Textual() string {
+	return c.text
+}
+
+func (c *codeBlockSegment) Update(fyne.CanvasObject) {}
+
+func (c *codeBlockSegment) Visual() fyne.CanvasObject {
+	code := widget.NewTextGridFromString(c.text)
+	copyButton := widget.NewButtonWithIcon("", theme.ContentCopyIcon(), func() {
+		if c.copyText != nil {
+			c.copyText(c.text)
+		}
+	})
+	copyButton.Importance = widget.LowImportance
+	bg := canvas.NewRectangle(theme.InputBackgroundColor())
+	buttons := container.New(layout.NewVBoxLayout(), copyButton)
+	return container.New(layout.NewMaxLayout(), bg,
+		container.New(layout.NewBorderLayout(nil, nil, nil, buttons), buttons, container.NewHScroll(code)))
+}
+
+func (c *codeBlockSegment) Select(fyne.Position, fyne.Position) {}
+
+func (c *codeBlockSegment) SelectedText() string {
+	return ""
+}
+
+func (c *codeBlockSegment) Unselect() {}
+
+// messageContentType returns the content type to send typed messages with.
+func (app *App) messageContentType() string {
+	if app.Preferences().BoolWithFallback(preferenceMarkdown, true) {
+		return ContentTypeMarkdown
+	}
+	return ContentTypeText
+}
+
+// newMarkdownCheck returns the check for sending messages formatted with Markdown.
+func (app *App) newMarkdownCheck() *widget.Check {
+	check := widget.NewCheck("Markdown", func(on bool) {
+		app.Preferences().SetBool(preferenceMarkdown, on)
+	})
+	check.SetChecked(app.Preferences().BoolWithFallback(preferenceMarkdown, true))
+	return check
+}
+
+// setPlain sets whether a Markdown message is shown as plain text in the chat and thread views.
+func (app *App) setPlain(id string, plain bool) {
+	app.chatView.SetPlain(id, plain)
+	app.threadView.SetPlain(id, plain)
+}
+
+// copyText copies text to the clipboard.
+func (app *App) copyText(s string) {
+	app.main.Clipboard().SetContent(s)
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2/dialog"
+	v1 "github.com/webmeshproj/api/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// membershipTTL is how long a membership key lives without being refreshed.
+	membershipTTL = time.Minute * 10
+	// membershipRefresh is how often membership keys of joined rooms are refreshed.
+	membershipRefresh = time.Minute * 4
+	// leftTTL is how long the member key of a node that left a room lives, so that
+	// others see that it left.
+	leftTTL = time.Second * 30
+
+	// memberJoined is the value of the member key of a node in a room. Legacy
+	// member keys have no value.
+	memberJoined = "joined"
+	// memberLeft is the value of the member key of a node that left a room.
+	memberLeft = "left"
+
+	// preferenceJoinedRooms is the preference holding the rooms we have joined.
+	preferenceJoinedRooms = "joinedRooms"
+)
+
+// MemberPath returns the storage path of a node's member key in a room.
+func MemberPath(roomName, nodeID string) string {
+	return path.Join(MembersPath(roomName), nodeID)
+}
+
+// preferenceList returns a list saved as a JSON array in a preference. Lists saved
+// by earlier versions as comma separated values are still read.
+func (app *App) preferenceList(key string) []string {
+	value := strings.TrimSpace(app.Preferences().String(key))
+	var list []string
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			app.log.Error("error decoding preference", "key", key, "error", err.Error())
+		}
+		return list
+	}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// setPreferenceList saves a list as a JSON array in a preference.
+func (app *App) setPreferenceList(key string, list []string) {
+	if list == nil {
+		list = []string{}
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		app.log.Error("error encoding preference", "key", key, "error", err.Error())
+		return
+	}
+	app.Preferences().SetString(key, string(data))
+}
+
+// joinedRooms returns the rooms we have joined.
+func (app *App) joinedRooms() []string {
+	return app.preferenceList(preferenceJoinedRooms)
+}
+
+// setJoined adds or removes a room from the rooms we have joined.
+func (app *App) setJoined(roomName string, joined bool) {
+	rooms := app.joinedRooms()
+	i := slices.Index(rooms, roomName)
+	switch {
+	case joined && i < 0:
+		rooms = append(rooms, roomName)
+	case !joined && i >= 0:
+		rooms = slices.Delete(rooms, i, i+1)
+	default:
+		return
+	}
+	app.setPreferenceList(preferenceJoinedRooms, rooms)
+}
+
+// publishMembership publishes or refreshes our member key in a room. It never
+// outlives the room itself.
+func (app *App) publishMembership(ctx context.Context, roomName string) error {
+	ourID, _ := app.nodeID.Get()
+	ttl := membershipTTL
+	if info := app.rooms.info(roomName); info != nil && info.ttl() > 0 && info.ttl() < ttl {
+		ttl = info.ttl()
+	}
+	err := app.doPublish(ctx, &v1.PublishRequest{
+		Key:   MemberPath(roomName, ourID),
+		Value: memberJoined,
+		Ttl:   durationpb.New(ttl),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish membership: %w", err)
+	}
+	return nil
+}
+
+// joinRoom joins a room if we have not joined it already.
+func (app *App) joinRoom(ctx context.Context, roomName string) error {
+	if slices.Contains(app.joinedRooms(), roomName) {
+		return nil
+	}
+	if err := app.publishMembership(ctx, roomName); err != nil {
+		return err
+	}
+	app.setJoined(roomName, true)
+	return nil
+}
+
+// refreshMemberships keeps our member keys in joined rooms alive until the context
+// is cancelled.
+func (app *App) refreshMemberships(ctx context.Context) {
+	ticker := time.NewTicker(membershipRefresh)
+	defer ticker.Stop()
+	for {
+		for _, roomName := range app.joinedRooms() {
+			if err := app.publishMembership(ctx, roomName); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				app.log.Error("error refreshing membership", "room", roomName, "error", err.Error())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// onLeaveRoom leaves the selected room after confirmation.
+func (app *App) onLeaveRoom() {
+	roomName := app.selectedRoom
+	if roomName == "" {
+		return
+	}
+	title := app.roomTitle(roomName)
+	dialog.ShowConfirm("Leave Room", fmt.Sprintf("Leave %s? Others will see that you left.", title), func(ok bool) {
+		if !ok {
+			return
+		}
+		if err := app.leaveRoom(roomName); err != nil {
+			app.log.Error("error leaving room", "room", roomName, "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
+		app.roomsListWidget.UnselectAll()
+		app.directListWidget.UnselectAll()
+	}, app.main)
+}
+
+// leaveRoom marks our member key in a room as left so that it expires shortly,
+// and forgets the room.
+func (app *App) leaveRoom(roomName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	ourID, _ := app.nodeID.Get()
+	err := app.doPublish(ctx, &v1.PublishRequest{
+		Key:   MemberPath(roomName, ourID),
+		Value: memberLeft,
+		Ttl:   durationpb.New(leftTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to leave room: %w", err)
+	}
+	if err := app.publishPresence(ctx, roomName, presenceOffline, leftTTL); err != nil {
+		app.log.Error("error publishing presence", "room", roomName, "error", err.Error())
+	}
+	app.setJoined(roomName, false)
+	if peerID := app.directPeerForRoom(roomName); peerID != "" {
+		app.removeDirectPeer(peerID)
+	}
+	return nil
+}
+
+// listMembers returns the nodes that are members of a room, along with all keys
+// under the room's members path.
+func (app *App) listMembers(ctx context.Context, cli v1.AppDaemonClient, roomName string) (members, keys []string, err error) {
+	keys, err = queryKeys(ctx, cli, MembersPath(roomName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list members: %w", err)
+	}
+	prefix := MembersPath(roomName) + "/"
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+		if len(parts) != 1 {
+			continue
+		}
+		// Skip members that left but whose keys have not expired yet.
+		if value, err := queryValue(ctx, cli, key); err == nil && value == memberLeft {
+			continue
+		}
+		members = append(members, parts[0])
+	}
+	return members, keys, nil
+}
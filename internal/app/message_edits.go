@@ -0,0 +1,95 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// honorRevision returns true if a revision of a message should be applied. Once a
+// sender's messages verify, their revisions must verify too.
+func (app *App) honorRevision(original, rev *chatEntry) bool {
+	return app.verifyMessage(original) != verifyOK || app.verifyMessage(rev) == verifyOK
+}
+
+// canEdit returns true if we can edit the message of an entry.
+func (app *App) canEdit(e *chatEntry) bool {
+	return app.canDelete(e) && strings.HasPrefix(e.current().ContentType, "text/")
+}
+
+// canDelete returns true if we can delete the message of an entry.
+func (app *App) canDelete(e *chatEntry) bool {
+	ourID, _ := app.nodeID.Get()
+	return e.message != nil && e.message.Version > 0 && e.message.From == ourID && !e.deleted()
+}
+
+// onEditMessage asks for the new text of a message and publishes it as a revision.
+func (app *App) onEditMessage(e *chatEntry) {
+	entry := widget.NewMultiLineEntry()
+	entry.Wrapping = fyne.TextWrapWord
+	entry.SetText(e.current().Body)
+	entry.Validator = func(s string) error {
+		if strings.TrimSpace(s) == "" {
+			return errors.New("message cannot be empty")
+		}
+		return nil
+	}
+	roomName := app.selectedRoom
+	dialog.ShowForm("Edit Message", "Save", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Message", entry),
+	}, func(ok bool) {
+		if !ok || entry.Text == e.current().Body {
+			return
+		}
+		go app.publishRevision(roomName, e, e.current().ContentType, entry.Text)
+	}, app.main)
+}
+
+// onDeleteMessage confirms and publishes a tombstone for a message.
+func (app *App) onDeleteMessage(e *chatEntry) {
+	roomName := app.selectedRoom
+	dialog.ShowConfirm("Delete Message", "Delete this message for everyone in the room?", func(ok bool) {
+		if !ok {
+			return
+		}
+		go app.publishRevision(roomName, e, ContentTypeTombstone, "")
+	}, app.main)
+}
+
+// publishRevision publishes a revision of a message to a room.
+func (app *App) publishRevision(roomName string, e *chatEntry, contentType, body string) {
+	nodeID, _ := app.nodeID.Get()
+	msg, err := NewChatMessage(nodeID, contentType, body)
+	if err != nil {
+		app.log.Error("error creating message", "error", err.Error())
+		return
+	}
+	msg.Replaces = e.message.ID
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := app.sendMessage(ctx, roomName, msg); err != nil {
+		app.log.Error("error sending revision", "error", err.Error())
+		dialog.ShowError(err, app.main)
+	}
+}
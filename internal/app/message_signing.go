@@ -0,0 +1,303 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// preferenceSigningKey is the preference earlier versions kept the seed of our
+	// message signing key in.
+	preferenceSigningKey = "signingKey"
+	// signingKeyFile is the file in the app storage directory holding the seed of our
+	// message signing key.
+	signingKeyFile = "signing.key"
+	// verifyCacheSize is the most message verification results cached.
+	verifyCacheSize = 10000
+	// preferencePinnedKeyPrefix prefixes the preferences holding the pinned signing keys of other nodes.
+	preferencePinnedKeyPrefix = "pinnedKey."
+)
+
+// verifyStatus is the result of verifying the sender of a message.
+type verifyStatus int
+
+const (
+	// verifyNone is for messages that cannot be verified, such as locked messages.
+	verifyNone verifyStatus = iota
+	// verifyOK is for messages signed with the sender's pinned key.
+	verifyOK
+	// verifyUnsigned is for messages without a signature.
+	verifyUnsigned
+	// verifyUnknownKey is for messages from a sender whose key we do not have.
+	verifyUnknownKey
+	// verifyBadSignature is for messages whose signature does not match the sender's key.
+	verifyBadSignature
+	// verifySenderMismatch is for messages whose sender is not the node in their key.
+	verifySenderMismatch
+	// verifyKeyChanged is for messages from a sender who published a different key than
+	// the one pinned.
+	verifyKeyChanged
+)
+
+// warning returns the warning to show with a message, or an empty string for none.
+func (s verifyStatus) warning() string {
+	switch s {
+	case verifyUnsigned:
+		return "unsigned"
+	case verifyUnknownKey:
+		return "unverified sender"
+	case verifyBadSignature:
+		return "invalid signature"
+	case verifySenderMismatch:
+		return "sender mismatch"
+	case verifyKeyChanged:
+		return "sender key changed"
+	default:
+		return ""
+	}
+}
+
+// signedMessage is the envelope of a signed message. The signature covers the storage
+// key and the exact bytes of the encoded message, so it does not depend on how the
+// message is encoded again after decoding.
+type signedMessage struct {
+	// Message is the encoded message.
+	Message json.RawMessage `json:"signed"`
+	// Signature is the sender's Ed25519 signature over the storage key and message.
+	Signature []byte `json:"sig"`
+}
+
+// signingPayload returns the bytes signed for an encoded message published at the given key.
+func signingPayload(storageKey string, data []byte) []byte {
+	return append([]byte(storageKey+"\x00"), data...)
+}
+
+// EncodeSigned returns the message encoded and signed for publishing at the given key.
+func (m *ChatMessage) EncodeSigned(key ed25519.PrivateKey, storageKey string) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode message: %w", err)
+	}
+	m.Signature = ed25519.Sign(key, signingPayload(storageKey, data))
+	m.signed = data
+	out, err := json.Marshal(&signedMessage{Message: data, Signature: m.Signature})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode signed message: %w", err)
+	}
+	return string(out), nil
+}
+
+// Verify returns true if the message published at the given key was signed with the key.
+func (m *ChatMessage) Verify(key ed25519.PublicKey, storageKey string) bool {
+	if len(m.Signature) != ed25519.SignatureSize || len(key) != ed25519.PublicKeySize || m.signed == nil {
+		return false
+	}
+	return ed25519.Verify(key, signingPayload(storageKey, m.signed), m.Signature)
+}
+
+// signingKey returns our message signing key, creating it on first use. The seed is
+// kept in a file in the app storage directory that only the user can read, rather
+// than in the preferences. It is not protected from other programs the user runs.
+func (app *App) signingKey() (ed25519.PrivateKey, error) {
+	app.keys.mu.Lock()
+	defer app.keys.mu.Unlock()
+	if app.keys.signing != nil {
+		return app.keys.signing, nil
+	}
+	key, err := app.loadSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	app.keys.signing = key
+	return key, nil
+}
+
+// loadSigningKey reads our message signing key, generating and saving it if there is none.
+func (app *App) loadSigningKey() (ed25519.PrivateKey, error) {
+	path := filepath.Join(app.Storage().RootURI().Path(), signingKeyFile)
+	if seed, err := os.ReadFile(path); err == nil && len(seed) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	// Move a seed saved in the preferences by earlier versions to the key file.
+	seed, err := base64.StdEncoding.DecodeString(app.Preferences().String(preferenceSigningKey))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		seed = key.Seed()
+	}
+	if err := writeKeyFile(path, seed); err != nil {
+		// Platforms without a writable storage directory keep the seed in the preferences.
+		app.log.Warn("error saving signing key, keeping it in preferences", "error", err.Error())
+		app.Preferences().SetString(preferenceSigningKey, base64.StdEncoding.EncodeToString(seed))
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	app.Preferences().SetString(preferenceSigningKey, "")
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// writeKeyFile writes a key readable only by the user. It is written to a temporary
+// file and renamed into place, so that a crash never leaves a partial key behind.
+func writeKeyFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// identityKeys caches our signing and direct message keys once they are loaded.
+// Loading is serialized so that concurrent first uses do not each generate a
+// different key.
+type identityKeys struct {
+	mu      sync.Mutex
+	signing ed25519.PrivateKey
+	direct  *ecdh.PrivateKey
+}
+
+// verifyCache holds the verification status of decoded messages until pinned or
+// published keys change, so that rows are not verified again on every layout.
+type verifyCache struct {
+	mu       sync.Mutex
+	statuses map[*ChatMessage]verifyStatus
+}
+
+// get returns the cached status of a message.
+func (c *verifyCache) get(m *ChatMessage) (verifyStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, ok := c.statuses[m]
+	return status, ok
+}
+
+// set caches the status of a message, starting over once the cache is full.
+func (c *verifyCache) set(m *ChatMessage, status verifyStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.statuses == nil || len(c.statuses) >= verifyCacheSize {
+		c.statuses = make(map[*ChatMessage]verifyStatus)
+	}
+	c.statuses[m] = status
+}
+
+// clear drops all cached statuses.
+func (c *verifyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statuses = nil
+}
+
+// pinnedKey returns the signing key pinned for a node, or nil if none is pinned.
+func (app *App) pinnedKey(nodeID string) ed25519.PublicKey {
+	key, err := base64.StdEncoding.DecodeString(app.Preferences().String(preferencePinnedKeyPrefix + nodeID))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil
+	}
+	return key
+}
+
+// pinKey pins the signing key of a node.
+func (app *App) pinKey(nodeID string, key ed25519.PublicKey) {
+	app.Preferences().SetString(preferencePinnedKeyPrefix+nodeID, base64.StdEncoding.EncodeToString(key))
+	app.verified.clear()
+}
+
+// pinFirstKey pins the signing key a node published if no key is pinned for it yet.
+func (app *App) pinFirstKey(nodeID string, p *Profile) {
+	if len(p.SigningKey) != ed25519.PublicKeySize || app.pinnedKey(nodeID) != nil {
+		return
+	}
+	app.pinKey(nodeID, p.SigningKey)
+}
+
+// trustPublishedKey replaces the pinned key of a node with the key it currently publishes.
+func (app *App) trustPublishedKey(nodeID string) error {
+	key := app.profiles.signingKey(nodeID)
+	if key == nil {
+		return errors.New("node has not published a signing key")
+	}
+	app.pinKey(nodeID, key)
+	app.chatView.Invalidate()
+	return nil
+}
+
+// verifyMessage checks the signature of a message entry against the sender's pinned key.
+func (app *App) verifyMessage(e *chatEntry) verifyStatus {
+	if e.message == nil {
+		return verifyNone
+	}
+	if status, ok := app.verified.get(e.message); ok {
+		return status
+	}
+	status := app.checkMessage(e)
+	app.verified.set(e.message, status)
+	return status
+}
+
+// checkMessage checks the signature of a message entry without the cache.
+func (app *App) checkMessage(e *chatEntry) verifyStatus {
+	msg := e.message
+	switch {
+	case msg == nil || msg.ContentType == ContentTypeLocked:
+		return verifyNone
+	case len(msg.Signature) == 0:
+		return verifyUnsigned
+	}
+	if from, _ := parseMessageKey(e.key); from != msg.From {
+		return verifySenderMismatch
+	}
+	pinned := app.pinnedKey(msg.From)
+	if pinned == nil {
+		return verifyUnknownKey
+	}
+	if published := app.profiles.signingKey(msg.From); published != nil && !bytes.Equal(published, pinned) {
+		return verifyKeyChanged
+	}
+	if !msg.Verify(pinned, e.key) {
+		return verifyBadSignature
+	}
+	return verifyOK
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestSignedMessageVerifies(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewChatMessage("node", ContentTypeText, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewMessageKey("room", "node")
+	value, err := msg.EncodeSigned(priv, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := DecodeChatMessage(key, value)
+	if got.Body != "hello" || !got.Verify(pub, key) {
+		t.Fatalf("decoded %+v does not verify", got)
+	}
+	if got.Verify(pub, NewMessageKey("other", "node")) {
+		t.Fatal("verified a message moved to another key")
+	}
+	// The signature covers the published bytes, not the decoded fields.
+	tampered := DecodeChatMessage(key, strings.Replace(value, "hello", "hellO", 1))
+	if tampered.Body != "hellO" || tampered.Verify(pub, key) {
+		t.Fatalf("verified tampered message %+v", tampered)
+	}
+}
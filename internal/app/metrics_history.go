@@ -0,0 +1,334 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	v1 "github.com/webmeshproj/api/v1"
+)
+
+// metricsExportRanges are the selectable time ranges for exporting metrics.
+var metricsExportRanges = map[string]time.Duration{
+	"Last hour":    time.Hour,
+	"Last day":     time.Hour * 24,
+	"Last week":    time.Hour * 24 * 7,
+	"Last 30 days": time.Hour * 24 * 30,
+	"All":          0,
+}
+
+// metricsExportRangeOptions are the export range names in display order.
+var metricsExportRangeOptions = []string{"Last hour", "Last day", "Last week", "Last 30 days", "All"}
+
+const (
+	// metricsHistoryFile is the name of the metrics history file in the app storage directory.
+	metricsHistoryFile = "metrics-history.dat"
+	// metricsRecordSize is the size of a single encoded history record.
+	metricsRecordSize = 24
+	// metricsFullResolution is how long samples are kept at full resolution before being downsampled.
+	metricsFullResolution = time.Hour * 24
+	// metricsCompactInterval is how often the history file is compacted.
+	metricsCompactInterval = time.Hour
+)
+
+// metricsRecord is a single sample in the metrics history. Totals are cumulative over
+// the whole history and already account for counter resets, so downsampling never loses
+// transferred bytes.
+type metricsRecord struct {
+	time      time.Time
+	totalSent uint64
+	totalRecv uint64
+}
+
+// metricsHistory is an append-only on-disk time series of interface transfer totals.
+type metricsHistory struct {
+	mu          sync.Mutex
+	path        string
+	retention   time.Duration
+	downsample  time.Duration
+	lastCompact time.Time
+	// last is the most recently written record.
+	last metricsRecord
+	// counters are the raw interface counters of the previous sample.
+	counters interfaceCounters
+}
+
+// openMetricsHistory opens the metrics history in the given directory, creating it if needed.
+func openMetricsHistory(dir string, retention, downsample time.Duration) (*metricsHistory, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create storage directory: %w", err)
+	}
+	h := &metricsHistory{
+		path:       filepath.Join(dir, metricsHistoryFile),
+		retention:  retention,
+		downsample: downsample,
+	}
+	records, err := h.readAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 {
+		h.last = records[len(records)-1]
+	}
+	if fi, err := os.Stat(h.path); err == nil && fi.Size() != int64(len(records)*metricsRecordSize) {
+		// Drop a partial record left by an interrupted write so appends stay aligned.
+		if err := os.Truncate(h.path, int64(len(records)*metricsRecordSize)); err != nil {
+			return nil, fmt.Errorf("truncate metrics history: %w", err)
+		}
+	}
+	return h, h.compact()
+}
+
+// configure updates the retention and downsampling interval of the history and compacts it.
+func (h *metricsHistory) configure(retention, downsample time.Duration) error {
+	h.mu.Lock()
+	h.retention, h.downsample = retention, downsample
+	h.mu.Unlock()
+	return h.compact()
+}
+
+// resetBaseline forgets the last raw counters seen, so the next sample starts a new baseline.
+func (h *metricsHistory) resetBaseline() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counters.reset()
+}
+
+// record appends a sample derived from the given metrics and returns the bytes
+// sent and received since the previous sample.
+func (h *metricsHistory) record(now time.Time, metrics *v1.InterfaceMetrics) (sent, recv uint64, err error) {
+	h.mu.Lock()
+	sent, recv, _ = h.counters.delta(metrics)
+	rec := metricsRecord{
+		time:      now,
+		totalSent: h.last.totalSent + sent,
+		totalRecv: h.last.totalRecv + recv,
+	}
+	h.last = rec
+	err = h.append(rec)
+	compact := now.Sub(h.lastCompact) >= metricsCompactInterval
+	h.mu.Unlock()
+	if err == nil && compact {
+		err = h.compact()
+	}
+	return sent, recv, err
+}
+
+// between returns the records with times in the range [from, to].
+func (h *metricsHistory) between(from, to time.Time) ([]metricsRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records, err := h.readAll()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]metricsRecord, 0, len(records))
+	for _, r := range records {
+		if r.time.Before(from) || r.time.After(to) {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// compact drops records older than the retention and downsamples records older
+// than the full resolution window.
+func (h *metricsHistory) compact() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.lastCompact = now
+	records, err := h.readAll()
+	if err != nil {
+		return err
+	}
+	kept := make([]metricsRecord, 0, len(records))
+	cutoff := now.Add(-h.retention)
+	fullRes := now.Add(-metricsFullResolution)
+	for i, r := range records {
+		if h.retention > 0 && r.time.Before(cutoff) {
+			continue
+		}
+		if h.downsample > 0 && r.time.Before(fullRes) && i+1 < len(records) {
+			// Keep only the last record of each downsample bucket. Totals are cumulative
+			// so the dropped records are accounted for by the one kept.
+			next := records[i+1]
+			if next.time.Before(fullRes) && next.time.Truncate(h.downsample).Equal(r.time.Truncate(h.downsample)) {
+				continue
+			}
+		}
+		kept = append(kept, r)
+	}
+	if len(kept) == len(records) {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, r := range kept {
+		buf.Write(encodeMetricsRecord(r))
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("write metrics history: %w", err)
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// append writes a record to the end of the history file. The caller must hold the lock.
+func (h *metricsHistory) append(r metricsRecord) error {
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open metrics history: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(encodeMetricsRecord(r)); err != nil {
+		return fmt.Errorf("write metrics history: %w", err)
+	}
+	return nil
+}
+
+// readAll reads every record in the history file. The caller must hold the lock.
+func (h *metricsHistory) readAll() ([]metricsRecord, error) {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read metrics history: %w", err)
+	}
+	// A trailing partial record from an interrupted write is ignored.
+	records := make([]metricsRecord, 0, len(data)/metricsRecordSize)
+	for len(data) >= metricsRecordSize {
+		records = append(records, decodeMetricsRecord(data[:metricsRecordSize]))
+		data = data[metricsRecordSize:]
+	}
+	return records, nil
+}
+
+func encodeMetricsRecord(r metricsRecord) []byte {
+	b := make([]byte, metricsRecordSize)
+	binary.LittleEndian.PutUint64(b[0:], uint64(r.time.Unix()))
+	binary.LittleEndian.PutUint64(b[8:], r.totalSent)
+	binary.LittleEndian.PutUint64(b[16:], r.totalRecv)
+	return b
+}
+
+func decodeMetricsRecord(b []byte) metricsRecord {
+	return metricsRecord{
+		time:      time.Unix(int64(binary.LittleEndian.Uint64(b[0:])), 0),
+		totalSent: binary.LittleEndian.Uint64(b[8:]),
+		totalRecv: binary.LittleEndian.Uint64(b[16:]),
+	}
+}
+
+// writeMetricsCSV writes the records as CSV with per-interval and cumulative byte counts.
+func writeMetricsCSV(w io.Writer, records []metricsRecord) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"timestamp", "sent_bytes", "received_bytes", "total_sent_bytes", "total_received_bytes"})
+	if err != nil {
+		return err
+	}
+	for i, r := range records {
+		var sent, recv uint64
+		if i > 0 {
+			sent = r.totalSent - records[i-1].totalSent
+			recv = r.totalRecv - records[i-1].totalRecv
+		}
+		err := cw.Write([]string{
+			r.time.UTC().Format(time.RFC3339),
+			strconv.FormatUint(sent, 10),
+			strconv.FormatUint(recv, 10),
+			strconv.FormatUint(r.totalSent, 10),
+			strconv.FormatUint(r.totalRecv, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// openHistory opens the metrics history in the app storage directory.
+func (app *App) openHistory() {
+	retention, _ := time.ParseDuration(app.Preferences().StringWithFallback(preferenceMetricsRetention, "720h"))
+	downsample, _ := time.ParseDuration(app.Preferences().StringWithFallback(preferenceMetricsDownsample, "5m"))
+	history, err := openMetricsHistory(app.Storage().RootURI().Path(), retention, downsample)
+	if err != nil {
+		app.log.Error("error opening metrics history", "error", err.Error())
+		return
+	}
+	app.history = history
+}
+
+// onExportMetrics prompts for a time range and file and exports the metrics history as CSV.
+func (app *App) onExportMetrics() {
+	if app.history == nil {
+		dialog.ShowError(errors.New("metrics history is not available"), app.main)
+		return
+	}
+	rangeSelect := widget.NewSelect(metricsExportRangeOptions, func(string) {})
+	rangeSelect.SetSelected(metricsExportRangeOptions[1])
+	dialog.ShowForm("Export Metrics", "Export", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Time Range", rangeSelect),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		to := time.Now()
+		var from time.Time
+		if d := metricsExportRanges[rangeSelect.Selected]; d > 0 {
+			from = to.Add(-d)
+		}
+		records, err := app.history.between(from, to)
+		if err != nil {
+			app.log.Error("error reading metrics history", "error", err.Error())
+			dialog.ShowError(err, app.main)
+			return
+		}
+		save := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, app.main)
+				return
+			}
+			if w == nil {
+				// The dialog was cancelled.
+				return
+			}
+			defer w.Close()
+			if err := writeMetricsCSV(w, records); err != nil {
+				app.log.Error("error exporting metrics", "error", err.Error())
+				dialog.ShowError(fmt.Errorf("failed to export metrics: %w", err), app.main)
+			}
+		}, app.main)
+		save.SetFileName(fmt.Sprintf("webmesh-metrics-%s.csv", to.Format("20060102-150405")))
+		save.Show()
+	}, app.main)
+}
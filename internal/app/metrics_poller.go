@@ -0,0 +1,129 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"time"
+
+	"fyne.io/fyne/v2/container"
+)
+
+const (
+	// peersTabName is the name of the tab showing per-peer statistics.
+	peersTabName = "Peers"
+	// metricsPollPeers is the metrics polling interval while the peers tab is shown
+	// in the foreground.
+	metricsPollPeers = time.Second * 2
+	// metricsPollForeground is the metrics polling interval while the app is in the
+	// foreground showing another tab.
+	metricsPollForeground = time.Second * 5
+	// metricsPollBackground is the metrics polling interval while the app is in the background.
+	// Polling continues so that the metrics history and quotas stay current.
+	metricsPollBackground = time.Second * 30
+	// metricsPollMaxBackoff is the longest interval between polls after repeated errors.
+	metricsPollMaxBackoff = time.Minute * 2
+)
+
+// pollMetrics polls the node for interface metrics until the context is cancelled.
+// The AppDaemon API only offers unary metrics, so polling adapts its interval to
+// whether the app is in the foreground and showing the peers tab, and backs off
+// exponentially on errors.
+func (app *App) pollMetrics(ctx context.Context) {
+	var failures int
+	timer := time.NewTimer(app.metricsPollInterval(failures))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-app.metricsPollWake:
+			// The app came to the foreground or the peers tab was shown, poll now
+			// rather than waiting out a slower or backoff interval.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			failures = 0
+			timer.Reset(0)
+			continue
+		case <-timer.C:
+		}
+		metrics, err := app.getNodeMetrics(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			app.log.Error("error getting interface metrics", "error", err.Error(), "failures", failures)
+		} else {
+			failures = 0
+			app.updateInterfaceMetrics(metrics)
+		}
+		timer.Reset(app.metricsPollInterval(failures))
+	}
+}
+
+// metricsPollInterval returns the interval until the next poll after the given number
+// of consecutive failures.
+func (app *App) metricsPollInterval(failures int) time.Duration {
+	interval := metricsPollBackground
+	if app.foreground.Load() {
+		interval = metricsPollForeground
+		if app.peersVisible.Load() {
+			interval = metricsPollPeers
+		}
+	}
+	for i := 0; i < failures && interval < metricsPollMaxBackoff; i++ {
+		interval *= 2
+	}
+	if interval > metricsPollMaxBackoff {
+		interval = metricsPollMaxBackoff
+	}
+	return interval
+}
+
+// onForegroundChange records whether the app is in the foreground and wakes the
+// metrics poller when it returns to it.
+func (app *App) onForegroundChange(foreground bool) func() {
+	return func() {
+		app.foreground.Store(foreground)
+		if foreground {
+			app.wakeMetricsPoller()
+		}
+	}
+}
+
+// onTabSelected records whether the peers tab is shown and wakes the metrics poller
+// when it is.
+func (app *App) onTabSelected(tab *container.TabItem) {
+	peers := tab.Text == peersTabName
+	app.peersVisible.Store(peers)
+	if peers {
+		app.wakeMetricsPoller()
+	}
+}
+
+// wakeMetricsPoller makes the metrics poller poll now.
+func (app *App) wakeMetricsPoller() {
+	select {
+	case app.metricsPollWake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	v1 "github.com/webmeshproj/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "webmesh_app"
+
+// appMetrics holds the Prometheus metrics collected by the app.
+type appMetrics struct {
+	registry *prometheus.Registry
+	// iface is the latest interface metrics republished on scrape.
+	iface atomic.Pointer[v1.InterfaceMetrics]
+
+	rpcRequests        *prometheus.CounterVec
+	rpcDuration        *prometheus.HistogramVec
+	messagesSent       *prometheus.CounterVec
+	messagesReceived   *prometheus.CounterVec
+	reconnects         prometheus.Counter
+	subscriptionErrors *prometheus.CounterVec
+
+	mu     sync.Mutex
+	server *http.Server
+	log    *slog.Logger
+}
+
+// newAppMetrics returns a new set of app metrics registered with a dedicated registry.
+func newAppMetrics() *appMetrics {
+	m := &appMetrics{
+		registry: prometheus.NewRegistry(),
+		log:      slog.Default(),
+		rpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_requests_total",
+			Help:      "Total number of RPCs made to the node by method and status code.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "Latency of unary RPCs made to the node by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "chat_messages_sent_total",
+			Help:      "Total number of chat messages sent by room.",
+		}, []string{"room"}),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "chat_messages_received_total",
+			Help:      "Total number of chat messages received by room.",
+		}, []string{"room"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconnects_total",
+			Help:      "Total number of times the app reconnected to the mesh.",
+		}),
+		subscriptionErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscription_errors_total",
+			Help:      "Total number of errors receiving from storage subscriptions by subscription.",
+		}, []string{"subscription"}),
+	}
+	m.registry.MustRegister(
+		m,
+		m.rpcRequests,
+		m.rpcDuration,
+		m.messagesSent,
+		m.messagesReceived,
+		m.reconnects,
+		m.subscriptionErrors,
+	)
+	return m
+}
+
+var (
+	ifaceTransmitBytesDesc = prometheus.NewDesc(metricsNamespace+"_interface_transmit_bytes_total",
+		"Total bytes transmitted on the mesh interface.", []string{"device"}, nil)
+	ifaceReceiveBytesDesc = prometheus.NewDesc(metricsNamespace+"_interface_receive_bytes_total",
+		"Total bytes received on the mesh interface.", []string{"device"}, nil)
+	ifacePeersDesc = prometheus.NewDesc(metricsNamespace+"_interface_peers",
+		"Number of peers connected to the mesh interface.", []string{"device"}, nil)
+	peerTransmitBytesDesc = prometheus.NewDesc(metricsNamespace+"_peer_transmit_bytes_total",
+		"Total bytes transmitted to a peer.", []string{"device", "public_key"}, nil)
+	peerReceiveBytesDesc = prometheus.NewDesc(metricsNamespace+"_peer_receive_bytes_total",
+		"Total bytes received from a peer.", []string{"device", "public_key"}, nil)
+)
+
+// Describe implements prometheus.Collector for the republished interface metrics.
+func (m *appMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ifaceTransmitBytesDesc
+	ch <- ifaceReceiveBytesDesc
+	ch <- ifacePeersDesc
+	ch <- peerTransmitBytesDesc
+	ch <- peerReceiveBytesDesc
+}
+
+// Collect implements prometheus.Collector for the republished interface metrics.
+func (m *appMetrics) Collect(ch chan<- prometheus.Metric) {
+	iface := m.iface.Load()
+	if iface == nil {
+		return
+	}
+	device := iface.GetDeviceName()
+	ch <- prometheus.MustNewConstMetric(ifaceTransmitBytesDesc, prometheus.CounterValue, float64(iface.GetTotalTransmitBytes()), device)
+	ch <- prometheus.MustNewConstMetric(ifaceReceiveBytesDesc, prometheus.CounterValue, float64(iface.GetTotalReceiveBytes()), device)
+	ch <- prometheus.MustNewConstMetric(ifacePeersDesc, prometheus.GaugeValue, float64(iface.GetNumPeers()), device)
+	for _, peer := range iface.GetPeers() {
+		ch <- prometheus.MustNewConstMetric(peerTransmitBytesDesc, prometheus.CounterValue, float64(peer.GetTransmitBytes()),
+			device, peer.GetPublicKey())
+		ch <- prometheus.MustNewConstMetric(peerReceiveBytesDesc, prometheus.CounterValue, float64(peer.GetReceiveBytes()),
+			device, peer.GetPublicKey())
+	}
+}
+
+// unaryInterceptor records the count and latency of unary RPCs.
+func (m *appMetrics) unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	m.rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	m.rpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	return err
+}
+
+// streamInterceptor records the count of streaming RPCs.
+func (m *appMetrics) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	m.rpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	return stream, err
+}
+
+// serve starts serving metrics on the given loopback port, replacing any running listener.
+func (m *appMetrics) serve(port string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shutdownLocked()
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Handler: mux, ReadHeaderTimeout: time.Second * 10}
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.log.Error("error serving metrics", "error", err.Error())
+			m.mu.Lock()
+			if m.server == srv {
+				m.server = nil
+			}
+			m.mu.Unlock()
+		}
+	}(m.server)
+	return nil
+}
+
+// shutdown stops the metrics listener if it is running.
+func (m *appMetrics) shutdown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shutdownLocked()
+}
+
+func (m *appMetrics) shutdownLocked() {
+	if m.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_ = m.server.Shutdown(ctx)
+	m.server = nil
+}
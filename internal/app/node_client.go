@@ -90,10 +90,57 @@ func (app *App) dialNode(ctx context.Context) (*grpc.ClientConn, error) {
 		return nil, err
 	}
 	socket := strings.TrimPrefix(socketAddr, "tcp://")
-	c, err := grpc.DialContext(ctx, socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	c, err := grpc.DialContext(ctx, socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(app.metrics.unaryInterceptor),
+		grpc.WithChainStreamInterceptor(app.metrics.streamInterceptor),
+	)
 	if err != nil {
 		app.log.Error("failed to connect to node", "error", err.Error())
 		return nil, err
 	}
 	return c, nil
 }
+
+// queryValue returns the value stored at the given key.
+func queryValue(ctx context.Context, cli v1.AppDaemonClient, key string) (string, error) {
+	resp, err := cli.Query(ctx, &v1.QueryRequest{
+		Command: v1.QueryRequest_GET,
+		Query:   key,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.CloseSend()
+	result, err := resp.Recv()
+	if err != nil {
+		return "", err
+	}
+	if result.GetError() != "" {
+		return "", fmt.Errorf("query %s: %s", key, result.GetError())
+	}
+	if len(result.GetValue()) == 0 {
+		return "", nil
+	}
+	return result.GetValue()[0], nil
+}
+
+// queryKeys returns the keys stored under the given prefix.
+func queryKeys(ctx context.Context, cli v1.AppDaemonClient, prefix string) ([]string, error) {
+	resp, err := cli.Query(ctx, &v1.QueryRequest{
+		Command: v1.QueryRequest_LIST,
+		Query:   prefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.CloseSend()
+	result, err := resp.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if result.GetError() != "" {
+		return nil, fmt.Errorf("list %s: %s", prefix, result.GetError())
+	}
+	return result.GetValue(), nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+var (
+	nodeAddressV4  = binding.NewString()
+	nodeAddressV6  = binding.NewString()
+	nodePublicKey  = binding.NewString()
+	nodeListenPort = binding.NewString()
+)
+
+// newNodeInfoPanel returns an expandable panel displaying the local node's interface details.
+func (app *App) newNodeInfoPanel() fyne.CanvasObject {
+	grid := container.New(layout.NewFormLayout())
+	for _, field := range []struct {
+		name string
+		val  binding.String
+	}{
+		{"Mesh IPv4", nodeAddressV4},
+		{"Mesh IPv6", nodeAddressV6},
+		{"Public Key", nodePublicKey},
+		{"Listen Port", nodeListenPort},
+	} {
+		val := field.val
+		label := widget.NewLabel(field.name)
+		label.TextStyle.Bold = true
+		value := widget.NewLabelWithData(val)
+		value.TextStyle.Monospace = true
+		copyButton := widget.NewButtonWithIcon("", theme.ContentCopyIcon(), func() {
+			s, _ := val.Get()
+			if s == "" || s == "---" {
+				return
+			}
+			app.main.Clipboard().SetContent(s)
+		})
+		grid.Add(label)
+		grid.Add(container.New(layout.NewHBoxLayout(), value, copyButton, layout.NewSpacer()))
+	}
+	return widget.NewAccordion(widget.NewAccordionItem("Node Info", grid))
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"fyne.io/fyne/v2"
+)
+
+// preferenceMutedRooms is the preference holding the rooms notifications are muted for.
+const preferenceMutedRooms = "mutedRooms"
+
+// unreadCounts counts the messages received in rooms that are not being viewed.
+type unreadCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newUnreadCounts() *unreadCounts {
+	return &unreadCounts{counts: make(map[string]int)}
+}
+
+// add increments the unread count of a room.
+func (u *unreadCounts) add(roomName string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.counts[roomName]++
+}
+
+// get returns the unread count of a room.
+func (u *unreadCounts) get(roomName string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.counts[roomName]
+}
+
+// clear resets the unread count of a room, or of all rooms if roomName is empty.
+func (u *unreadCounts) clear(roomName string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if roomName == "" {
+		u.counts = make(map[string]int)
+		return
+	}
+	delete(u.counts, roomName)
+}
+
+// badge returns the label suffix showing the unread count of a room.
+func (u *unreadCounts) badge(roomName string) string {
+	if n := u.get(roomName); n > 0 {
+		return fmt.Sprintf(" (%d)", n)
+	}
+	return ""
+}
+
+// mutedRooms returns the rooms notifications are muted for.
+func (app *App) mutedRooms() []string {
+	return app.preferenceList(preferenceMutedRooms)
+}
+
+// isMuted returns true if notifications are muted for a room.
+func (app *App) isMuted(roomName string) bool {
+	return slices.Contains(app.mutedRooms(), roomName)
+}
+
+// onToggleMute mutes or unmutes notifications for the selected room.
+func (app *App) onToggleMute() {
+	roomName := app.selectedRoom
+	if roomName == "" {
+		return
+	}
+	rooms := app.mutedRooms()
+	if i := slices.Index(rooms, roomName); i >= 0 {
+		rooms = slices.Delete(rooms, i, i+1)
+	} else {
+		rooms = append(rooms, roomName)
+	}
+	app.setPreferenceList(preferenceMutedRooms, rooms)
+	app.updateMuteButton()
+}
+
+// updateMuteButton updates the mute button for the selected room.
+func (app *App) updateMuteButton() {
+	if app.isMuted(app.selectedRoom) {
+		app.muteButton.SetText("Unmute")
+	} else {
+		app.muteButton.SetText("Mute")
+	}
+}
+
+// isRoomWatched returns true if we receive unread counts and notifications for a room.
+func (app *App) isRoomWatched(roomName string) bool {
+	if slices.Contains(app.joinedRooms(), roomName) {
+		return true
+	}
+	return isDirectRoom(roomName) && app.directPeerForRoom(roomName) != ""
+}
+
+// onRoomActivity handles a message published to any room. Messages in joined rooms
+// that are not being viewed count as unread, and raise a notification while the
+// window is not focused unless the room is muted. Edits and deletions are ignored.
+// Messages in joined rooms are added to the search index and the chat history.
+func (app *App) onRoomActivity(roomName, key, value string) {
+	if !app.isRoomWatched(roomName) {
+		return
+	}
+	app.recordMessage(key, value)
+	msg := app.openMessage(key, value)
+	app.search.add(key, msg)
+	if ourID, _ := app.nodeID.Get(); msg.From == ourID || msg.Replaces != "" {
+		return
+	}
+	if roomName != app.selectedRoom {
+		app.unread.add(roomName)
+		app.roomsListWidget.Refresh()
+		app.directListWidget.Refresh()
+	}
+	if app.foreground.Load() || app.isMuted(roomName) {
+		return
+	}
+	name, _ := app.profiles.name(msg.From)
+	title := fmt.Sprintf("%s in %s", name, roomName)
+	if isDirectRoom(roomName) {
+		title = fmt.Sprintf("Direct message from %s", name)
+	}
+	app.SendNotification(fyne.NewNotification(title, truncate(msg.displayText(), 120)))
+}
+
+// markRoomRead clears the unread count of a room.
+func (app *App) markRoomRead(roomName string) {
+	if app.unread.get(roomName) == 0 {
+		return
+	}
+	app.unread.clear(roomName)
+	app.roomsListWidget.Refresh()
+	app.directListWidget.Refresh()
+}
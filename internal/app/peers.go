@@ -0,0 +1,270 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	v1 "github.com/webmeshproj/api/v1"
+)
+
+// staleHandshakeTimeout is how long since the last handshake before a peer is considered stale.
+// WireGuard re-handshakes every two minutes on an active session.
+const staleHandshakeTimeout = time.Minute * 3
+
+const (
+	peerColumnPublicKey = iota
+	peerColumnEndpoint
+	peerColumnAllowedIPs
+	peerColumnHandshake
+	peerColumnReceived
+	peerColumnSent
+)
+
+// peerColumns are the headers of the peers table.
+var peerColumns = []string{"Public Key", "Endpoint", "Allowed IPs", "Last Handshake", "Received", "Sent"}
+
+// peerColumnWidths are the widths of the peers table columns.
+var peerColumnWidths = []float32{140, 180, 220, 140, 90, 90}
+
+// peersView renders the per-peer WireGuard statistics.
+type peersView struct {
+	mu       sync.Mutex
+	peers    []*v1.PeerMetrics
+	sortCol  int
+	sortDesc bool
+	selected string
+	// selectedCol is the column of the selected cell, so the selection can be restored.
+	selectedCol int
+
+	window   fyne.Window
+	table    *widget.Table
+	copyKey  *widget.Button
+	copyAddr *widget.Button
+}
+
+// newPeersView returns a new peers view that copies to the given window's clipboard.
+func newPeersView(window fyne.Window) *peersView {
+	v := &peersView{window: window, sortCol: peerColumnHandshake, sortDesc: true}
+	v.table = widget.NewTable(v.size, v.newCell, v.updateCell)
+	for i, w := range peerColumnWidths {
+		v.table.SetColumnWidth(i, w)
+	}
+	v.table.OnSelected = v.onSelected
+	v.copyKey = widget.NewButtonWithIcon("Copy Public Key", theme.ContentCopyIcon(), func() {
+		v.copySelected(func(p *v1.PeerMetrics) string { return p.GetPublicKey() })
+	})
+	v.copyAddr = widget.NewButtonWithIcon("Copy Endpoint", theme.ContentCopyIcon(), func() {
+		v.copySelected(func(p *v1.PeerMetrics) string { return p.GetEndpoint() })
+	})
+	v.copyKey.Disable()
+	v.copyAddr.Disable()
+	return v
+}
+
+// content returns the canvas object for the view.
+func (v *peersView) content() fyne.CanvasObject {
+	actions := container.New(layout.NewHBoxLayout(), layout.NewSpacer(), v.copyKey, v.copyAddr)
+	return container.New(layout.NewBorderLayout(nil, actions, nil, nil), v.table, actions)
+}
+
+// update replaces the displayed peers with the given metrics, keeping the selected
+// peer highlighted wherever it sorts to.
+func (v *peersView) update(peers []*v1.PeerMetrics) {
+	v.mu.Lock()
+	v.peers = peers
+	v.sortPeers()
+	row := -1
+	for i, p := range peers {
+		if p.GetPublicKey() == v.selected {
+			row = i + 1
+			break
+		}
+	}
+	if row < 0 {
+		v.selected = ""
+	}
+	v.mu.Unlock()
+	if row < 0 {
+		v.clearSelection()
+	} else {
+		v.table.Select(widget.TableCellID{Row: row, Col: v.selectedCol})
+	}
+	v.table.Refresh()
+}
+
+// clearSelection unselects the selected peer and disables the copy buttons.
+func (v *peersView) clearSelection() {
+	v.mu.Lock()
+	v.selected = ""
+	v.mu.Unlock()
+	v.table.UnselectAll()
+	v.copyKey.Disable()
+	v.copyAddr.Disable()
+}
+
+// sortPeers sorts the peers by the current sort column. The caller must hold the lock.
+func (v *peersView) sortPeers() {
+	sort.SliceStable(v.peers, func(i, j int) bool {
+		a, b := v.peers[i], v.peers[j]
+		if v.sortDesc {
+			a, b = b, a
+		}
+		switch v.sortCol {
+		case peerColumnEndpoint:
+			return a.GetEndpoint() < b.GetEndpoint()
+		case peerColumnAllowedIPs:
+			return strings.Join(a.GetAllowedIps(), ",") < strings.Join(b.GetAllowedIps(), ",")
+		case peerColumnHandshake:
+			return lastHandshake(a).Before(lastHandshake(b))
+		case peerColumnReceived:
+			return a.GetReceiveBytes() < b.GetReceiveBytes()
+		case peerColumnSent:
+			return a.GetTransmitBytes() < b.GetTransmitBytes()
+		default:
+			return a.GetPublicKey() < b.GetPublicKey()
+		}
+	})
+}
+
+func (v *peersView) size() (int, int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// The first row is the header.
+	return len(v.peers) + 1, len(peerColumns)
+}
+
+func (v *peersView) newCell() fyne.CanvasObject {
+	return canvas.NewText("", theme.ForegroundColor())
+}
+
+func (v *peersView) updateCell(id widget.TableCellID, obj fyne.CanvasObject) {
+	text := obj.(*canvas.Text)
+	text.Color = theme.ForegroundColor()
+	text.TextStyle = fyne.TextStyle{}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if id.Row == 0 {
+		text.TextStyle.Bold = true
+		text.Text = peerColumns[id.Col]
+		if id.Col == v.sortCol {
+			if v.sortDesc {
+				text.Text += " ▼"
+			} else {
+				text.Text += " ▲"
+			}
+		}
+		text.Refresh()
+		return
+	}
+	if id.Row-1 >= len(v.peers) {
+		text.Text = ""
+		text.Refresh()
+		return
+	}
+	peer := v.peers[id.Row-1]
+	handshake := lastHandshake(peer)
+	if handshake.IsZero() || time.Since(handshake) > staleHandshakeTimeout {
+		text.Color = theme.ErrorColor()
+	}
+	switch id.Col {
+	case peerColumnPublicKey:
+		text.Text = truncate(peer.GetPublicKey(), 16)
+	case peerColumnEndpoint:
+		text.Text = peer.GetEndpoint()
+	case peerColumnAllowedIPs:
+		text.Text = truncate(strings.Join(peer.GetAllowedIps(), ", "), 28)
+	case peerColumnHandshake:
+		text.Text = handshakeString(handshake)
+	case peerColumnReceived:
+		text.Text = bytesString(int(peer.GetReceiveBytes()))
+	case peerColumnSent:
+		text.Text = bytesString(int(peer.GetTransmitBytes()))
+	}
+	text.Refresh()
+}
+
+func (v *peersView) onSelected(id widget.TableCellID) {
+	if id.Row == 0 {
+		// Clicking a header sorts by that column, toggling the direction if already sorted.
+		v.mu.Lock()
+		if v.sortCol == id.Col {
+			v.sortDesc = !v.sortDesc
+		} else {
+			v.sortCol, v.sortDesc = id.Col, false
+		}
+		v.sortPeers()
+		v.mu.Unlock()
+		v.clearSelection()
+		v.table.Refresh()
+		return
+	}
+	v.mu.Lock()
+	if id.Row-1 < len(v.peers) {
+		v.selected = v.peers[id.Row-1].GetPublicKey()
+		v.selectedCol = id.Col
+	}
+	v.mu.Unlock()
+	v.copyKey.Enable()
+	v.copyAddr.Enable()
+}
+
+// copySelected copies the value returned by fn for the selected peer to the clipboard.
+func (v *peersView) copySelected(fn func(*v1.PeerMetrics) string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, p := range v.peers {
+		if p.GetPublicKey() == v.selected {
+			v.window.Clipboard().SetContent(fn(p))
+			return
+		}
+	}
+}
+
+// lastHandshake returns the last handshake time of the peer or the zero time if there has not been one.
+func lastHandshake(peer *v1.PeerMetrics) time.Time {
+	t, err := time.Parse(time.RFC3339, peer.GetLastHandshakeTime())
+	if err != nil || t.Unix() <= 0 {
+		return time.Time{}
+	}
+	return t
+}
+
+func handshakeString(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", time.Since(t).Truncate(time.Second))
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
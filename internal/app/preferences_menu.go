@@ -17,12 +17,15 @@ limitations under the License.
 package app
 
 import (
+	"context"
+	"fmt"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
@@ -41,6 +44,22 @@ const (
 	preferenceConnectTimeout = "connectTimeout"
 	preferenceNodeSocket     = "nodeSocket"
 	preferenceTURNServers    = "turnServers"
+	preferenceMetricsEnabled = "metricsEnabled"
+	preferenceMetricsPort    = "metricsPort"
+
+	preferenceMetricsRetention  = "metricsRetention"
+	preferenceMetricsDownsample = "metricsDownsample"
+
+	preferenceQuotaDailySend   = "quotaDailySend"
+	preferenceQuotaDailyRecv   = "quotaDailyRecv"
+	preferenceQuotaMonthlySend = "quotaMonthlySend"
+	preferenceQuotaMonthlyRecv = "quotaMonthlyRecv"
+	preferenceQuotaThresholds  = "quotaThresholds"
+	preferenceQuotaDisconnect  = "quotaDisconnect"
+
+	preferenceDisplayName = "displayName"
+	preferenceStatus      = "status"
+	preferenceAvatarColor = "avatarColor"
 )
 
 var (
@@ -54,6 +73,28 @@ var (
 	disableIPv6    = binding.NewBool()
 	connectTimeout = binding.NewString()
 	turnServers    = binding.NewString()
+	metricsEnabled = binding.NewBool()
+	metricsPort    = binding.NewString()
+
+	metricsRetention  = binding.NewString()
+	metricsDownsample = binding.NewString()
+
+	quotaDailySend   = binding.NewString()
+	quotaDailyRecv   = binding.NewString()
+	quotaMonthlySend = binding.NewString()
+	quotaMonthlyRecv = binding.NewString()
+	quotaThresholds  = binding.NewString()
+	quotaDisconnect  = binding.NewBool()
+
+	displayName = binding.NewString()
+	statusText  = binding.NewString()
+	avatarColor = binding.NewString()
+	reactions   = binding.NewString()
+
+	chatHistoryEnabled       = binding.NewBool()
+	chatHistoryProtect       = binding.NewBool()
+	chatHistoryPassphrase    = binding.NewString()
+	chatHistoryHasPassphrase = binding.NewBool()
 )
 
 // displayPreferences displays the preferences modal.
@@ -65,6 +106,12 @@ func (app *App) displayPreferences() {
 		app.timeoutsFormItem(),
 		app.turnServersFormItem(),
 		app.protocolFormItem(),
+		app.metricsFormItem(),
+		app.historyFormItem(),
+		app.quotasFormItem(),
+		app.profileFormItem(),
+		app.reactionsFormItem(),
+		app.chatHistoryFormItem(),
 	)
 	popup := widget.NewModalPopUp(
 		form,
@@ -103,6 +150,55 @@ func (app *App) displayPreferences() {
 		turnServers, _ := turnServers.Get()
 		turnServers = strings.TrimSpace(turnServers)
 		app.Preferences().SetString(preferenceTURNServers, strings.Replace(turnServers, "\n", ",", -1))
+		metricsEnabled, _ := metricsEnabled.Get()
+		app.Preferences().SetBool(preferenceMetricsEnabled, metricsEnabled)
+		metricsPort, _ := metricsPort.Get()
+		app.Preferences().SetString(preferenceMetricsPort, metricsPort)
+		app.applyMetricsServer()
+		metricsRetention, _ := metricsRetention.Get()
+		app.Preferences().SetString(preferenceMetricsRetention, metricsRetention)
+		metricsDownsample, _ := metricsDownsample.Get()
+		app.Preferences().SetString(preferenceMetricsDownsample, metricsDownsample)
+		if app.history != nil {
+			retention, _ := time.ParseDuration(metricsRetention)
+			downsample, _ := time.ParseDuration(metricsDownsample)
+			if err := app.history.configure(retention, downsample); err != nil {
+				app.log.Error("error compacting metrics history", "error", err.Error())
+			}
+		}
+		quotaDailySend, _ := quotaDailySend.Get()
+		app.Preferences().SetString(preferenceQuotaDailySend, quotaDailySend)
+		quotaDailyRecv, _ := quotaDailyRecv.Get()
+		app.Preferences().SetString(preferenceQuotaDailyRecv, quotaDailyRecv)
+		quotaMonthlySend, _ := quotaMonthlySend.Get()
+		app.Preferences().SetString(preferenceQuotaMonthlySend, quotaMonthlySend)
+		quotaMonthlyRecv, _ := quotaMonthlyRecv.Get()
+		app.Preferences().SetString(preferenceQuotaMonthlyRecv, quotaMonthlyRecv)
+		quotaThresholds, _ := quotaThresholds.Get()
+		app.Preferences().SetString(preferenceQuotaThresholds, quotaThresholds)
+		quotaDisconnect, _ := quotaDisconnect.Get()
+		app.Preferences().SetBool(preferenceQuotaDisconnect, quotaDisconnect)
+		displayName, _ := displayName.Get()
+		app.Preferences().SetString(preferenceDisplayName, strings.TrimSpace(displayName))
+		statusText, _ := statusText.Get()
+		app.Preferences().SetString(preferenceStatus, strings.TrimSpace(statusText))
+		avatarColor, _ := avatarColor.Get()
+		app.Preferences().SetString(preferenceAvatarColor, avatarColor)
+		reactions, _ := reactions.Get()
+		app.Preferences().SetString(preferenceReactions, strings.Join(parseReactions(reactions), ","))
+		chatHistoryEnabled, _ := chatHistoryEnabled.Get()
+		chatHistoryProtect, _ := chatHistoryProtect.Get()
+		chatHistoryPassphrase, _ := chatHistoryPassphrase.Get()
+		app.applyChatHistory(chatHistoryEnabled, chatHistoryProtect, chatHistoryPassphrase)
+		if app.connected.Load() {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+				defer cancel()
+				if err := app.publishProfile(ctx); err != nil {
+					app.log.Error("error publishing profile", "error", err.Error())
+				}
+			}()
+		}
 	}
 	popup.Show()
 }
@@ -209,3 +305,157 @@ func (app *App) turnServersFormItem() *widget.FormItem {
 	formItem.HintText = "Newline separated list of TURN servers to use for NAT traversal"
 	return formItem
 }
+
+func (app *App) metricsFormItem() *widget.FormItem {
+	metricsEnabled.Set(app.Preferences().BoolWithFallback(preferenceMetricsEnabled, false))
+	metricsPort.Set(app.Preferences().StringWithFallback(preferenceMetricsPort, "9099"))
+	enabledCheck := widget.NewCheckWithData("Enabled", metricsEnabled)
+	portEntry := widget.NewEntryWithData(metricsPort)
+	portEntry.Wrapping = fyne.TextWrapOff
+	portEntry.SetPlaceHolder("Metrics port")
+	portEntry.Validator = func(s string) error {
+		_, err := strconv.ParseUint(s, 10, 16)
+		return err
+	}
+	formItem := widget.NewFormItem("Metrics", fyne.NewContainerWithLayout(layout.NewHBoxLayout(),
+		enabledCheck, widget.NewLabel("Port"), portEntry,
+	))
+	formItem.HintText = "Serve Prometheus metrics on the loopback interface"
+	return formItem
+}
+
+func (app *App) historyFormItem() *widget.FormItem {
+	metricsRetention.Set(app.Preferences().StringWithFallback(preferenceMetricsRetention, "720h"))
+	metricsDownsample.Set(app.Preferences().StringWithFallback(preferenceMetricsDownsample, "5m"))
+	isValidDuration := func(s string) error {
+		_, err := time.ParseDuration(s)
+		return err
+	}
+	retentionEntry := widget.NewEntryWithData(metricsRetention)
+	retentionEntry.Wrapping = fyne.TextWrapOff
+	retentionEntry.Validator = isValidDuration
+	retentionEntry.SetPlaceHolder("Retention")
+	downsampleEntry := widget.NewEntryWithData(metricsDownsample)
+	downsampleEntry.Wrapping = fyne.TextWrapOff
+	downsampleEntry.Validator = isValidDuration
+	downsampleEntry.SetPlaceHolder("Downsample interval")
+	formItem := widget.NewFormItem("Metrics History", fyne.NewContainerWithLayout(layout.NewHBoxLayout(),
+		widget.NewLabel("Retention"), retentionEntry,
+		widget.NewLabel("Downsample"), downsampleEntry,
+	))
+	formItem.HintText = "How long to keep interface metrics and the interval to reduce samples older than a day to"
+	return formItem
+}
+
+func (app *App) quotasFormItem() *widget.FormItem {
+	quotaDailySend.Set(app.Preferences().String(preferenceQuotaDailySend))
+	quotaDailyRecv.Set(app.Preferences().String(preferenceQuotaDailyRecv))
+	quotaMonthlySend.Set(app.Preferences().String(preferenceQuotaMonthlySend))
+	quotaMonthlyRecv.Set(app.Preferences().String(preferenceQuotaMonthlyRecv))
+	quotaThresholds.Set(app.Preferences().StringWithFallback(preferenceQuotaThresholds, "80,90,100"))
+	quotaDisconnect.Set(app.Preferences().BoolWithFallback(preferenceQuotaDisconnect, false))
+	isValidSize := func(s string) error {
+		_, err := parseBytes(s)
+		return err
+	}
+	newQuotaEntry := func(val binding.String, placeholder string) *widget.Entry {
+		entry := widget.NewEntryWithData(val)
+		entry.Wrapping = fyne.TextWrapOff
+		entry.Validator = isValidSize
+		entry.SetPlaceHolder(placeholder)
+		return entry
+	}
+	thresholdsEntry := widget.NewEntryWithData(quotaThresholds)
+	thresholdsEntry.Wrapping = fyne.TextWrapOff
+	thresholdsEntry.SetPlaceHolder("80,90,100")
+	disconnectCheck := widget.NewCheckWithData("Disconnect at cap", quotaDisconnect)
+	formItem := widget.NewFormItem("Quotas", container.New(layout.NewVBoxLayout(),
+		container.New(layout.NewGridLayout(4),
+			widget.NewLabel("Daily send"), newQuotaEntry(quotaDailySend, "Unlimited"),
+			widget.NewLabel("Daily receive"), newQuotaEntry(quotaDailyRecv, "Unlimited"),
+			widget.NewLabel("Monthly send"), newQuotaEntry(quotaMonthlySend, "Unlimited"),
+			widget.NewLabel("Monthly receive"), newQuotaEntry(quotaMonthlyRecv, "Unlimited"),
+		),
+		container.New(layout.NewHBoxLayout(),
+			widget.NewLabel("Alert at %"), thresholdsEntry, disconnectCheck,
+		),
+	))
+	formItem.HintText = "Bandwidth quotas (e.g. 10GB), usage percentages to notify at, and whether to disconnect when a quota is used up"
+	return formItem
+}
+
+func (app *App) profileFormItem() *widget.FormItem {
+	displayName.Set(app.Preferences().String(preferenceDisplayName))
+	statusText.Set(app.Preferences().String(preferenceStatus))
+	avatarColor.Set(app.Preferences().String(preferenceAvatarColor))
+	nameEntry := widget.NewEntryWithData(displayName)
+	nameEntry.Wrapping = fyne.TextWrapOff
+	nameEntry.SetPlaceHolder("Node ID")
+	statusEntry := widget.NewEntryWithData(statusText)
+	statusEntry.Wrapping = fyne.TextWrapOff
+	statusEntry.SetPlaceHolder("Status")
+	colorEntry := widget.NewEntryWithData(avatarColor)
+	colorEntry.Wrapping = fyne.TextWrapOff
+	colorEntry.SetPlaceHolder("#RRGGBB")
+	formItem := widget.NewFormItem("Profile", container.New(layout.NewGridLayout(2),
+		widget.NewLabel("Display name"), nameEntry,
+		widget.NewLabel("Status"), statusEntry,
+		widget.NewLabel("Avatar color"), colorEntry,
+	))
+	formItem.HintText = "How other users see you in chat rooms"
+	return formItem
+}
+
+func (app *App) reactionsFormItem() *widget.FormItem {
+	reactions.Set(strings.Join(app.reactionSet(), ", "))
+	reactionsEntry := widget.NewEntryWithData(reactions)
+	reactionsEntry.Wrapping = fyne.TextWrapOff
+	reactionsEntry.SetPlaceHolder(defaultReactions)
+	formItem := widget.NewFormItem("Reactions", reactionsEntry)
+	formItem.HintText = "Comma separated reactions offered when reacting to a message"
+	return formItem
+}
+
+func (app *App) chatHistoryFormItem() *widget.FormItem {
+	protected := app.Preferences().String(preferenceChatHistorySalt) != ""
+	chatHistoryEnabled.Set(app.Preferences().BoolWithFallback(preferenceChatHistory, true))
+	chatHistoryProtect.Set(protected)
+	chatHistoryHasPassphrase.Set(protected)
+	chatHistoryPassphrase.Set("")
+	enabledCheck := widget.NewCheckWithData("Keep on this device", chatHistoryEnabled)
+	protectCheck := widget.NewCheckWithData("Protect with a passphrase", chatHistoryProtect)
+	passphraseEntry := widget.NewEntryWithData(chatHistoryPassphrase)
+	passphraseEntry.Password = true
+	passphraseEntry.Wrapping = fyne.TextWrapOff
+	if protected {
+		passphraseEntry.SetPlaceHolder("Unchanged")
+	} else {
+		passphraseEntry.SetPlaceHolder("Passphrase")
+	}
+	clearButton := widget.NewButton("Clear", func() {
+		dialog.ShowConfirm("Clear Chat History", "Delete the chat history kept on this device?", func(ok bool) {
+			if ok {
+				app.clearChatHistory()
+			}
+		}, app.main)
+	})
+	formItem := widget.NewFormItem("Chat History", container.New(layout.NewVBoxLayout(),
+		container.New(layout.NewHBoxLayout(), enabledCheck, protectCheck, clearButton),
+		passphraseEntry,
+	))
+	formItem.HintText = "Keep an encrypted copy of rooms and messages for instant and offline reading. Without a passphrase, its key is kept in the app preferences"
+	return formItem
+}
+
+// applyMetricsServer starts or stops the metrics listener according to the saved preferences.
+func (app *App) applyMetricsServer() {
+	if !app.Preferences().BoolWithFallback(preferenceMetricsEnabled, false) {
+		app.metrics.shutdown()
+		return
+	}
+	port := app.Preferences().StringWithFallback(preferenceMetricsPort, "9099")
+	if err := app.metrics.serve(port); err != nil {
+		app.log.Error("error starting metrics server", "error", err.Error())
+		dialog.ShowError(fmt.Errorf("failed to start metrics server: %w", err), app.main)
+	}
+}
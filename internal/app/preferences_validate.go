@@ -17,9 +17,12 @@ limitations under the License.
 package app
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"fyne.io/fyne/v2/data/binding"
 )
@@ -28,6 +31,12 @@ func validatePreferences() error {
 	for _, val := range []func() error{
 		validatePorts,
 		validateConnectTimeout,
+		validateMetricsPort,
+		validateMetricsHistory,
+		validateQuotas,
+		validateProfile,
+		validateReactions,
+		validateChatHistory,
 	} {
 		if err := val(); err != nil {
 			return err
@@ -70,3 +79,135 @@ func validateConnectTimeout() error {
 	}
 	return nil
 }
+
+func validateMetricsPort() error {
+	enabled, err := metricsEnabled.Get()
+	if err != nil || !enabled {
+		return err
+	}
+	val, err := metricsPort.Get()
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(val, 10, 16); err != nil {
+		return fmt.Errorf("metrics port is not a valid port: %s", val)
+	}
+	return nil
+}
+
+func validateMetricsHistory() error {
+	for _, bd := range []struct {
+		name string
+		val  binding.String
+	}{
+		{"metrics retention", metricsRetention},
+		{"metrics downsample interval", metricsDownsample},
+	} {
+		val, err := bd.val.Get()
+		if err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("%s is invalid: %w", bd.name, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("%s cannot be negative", bd.name)
+		}
+	}
+	return nil
+}
+
+func validateQuotas() error {
+	for _, bd := range []struct {
+		name string
+		val  binding.String
+	}{
+		{"Daily send quota", quotaDailySend},
+		{"Daily receive quota", quotaDailyRecv},
+		{"Monthly send quota", quotaMonthlySend},
+		{"Monthly receive quota", quotaMonthlyRecv},
+	} {
+		val, err := bd.val.Get()
+		if err != nil {
+			return err
+		}
+		if _, err := parseBytes(val); err != nil {
+			return fmt.Errorf("%s is invalid: %w", bd.name, err)
+		}
+	}
+	val, err := quotaThresholds.Get()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(val) != "" && len(parseThresholds(val)) == 0 {
+		return fmt.Errorf("quota alert thresholds are invalid: %s", val)
+	}
+	return nil
+}
+
+func validateProfile() error {
+	name, err := displayName.Get()
+	if err != nil {
+		return err
+	}
+	if utf8.RuneCountInString(strings.TrimSpace(name)) > maxDisplayNameLength {
+		return fmt.Errorf("display name cannot be longer than %d characters", maxDisplayNameLength)
+	}
+	status, err := statusText.Get()
+	if err != nil {
+		return err
+	}
+	if utf8.RuneCountInString(strings.TrimSpace(status)) > maxStatusLength {
+		return fmt.Errorf("status cannot be longer than %d characters", maxStatusLength)
+	}
+	color, err := avatarColor.Get()
+	if err != nil {
+		return err
+	}
+	if color != "" {
+		if _, err := parseHexColor(color); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateReactions() error {
+	val, err := reactions.Get()
+	if err != nil {
+		return err
+	}
+	set := parseReactions(val)
+	if len(set) > maxReactions {
+		return fmt.Errorf("cannot have more than %d reactions", maxReactions)
+	}
+	for _, r := range set {
+		if len([]rune(r)) > maxReactionLength {
+			return fmt.Errorf("reaction %q cannot be longer than %d characters", r, maxReactionLength)
+		}
+	}
+	return nil
+}
+
+func validateChatHistory() error {
+	protect, err := chatHistoryProtect.Get()
+	if err != nil {
+		return err
+	}
+	passphrase, err := chatHistoryPassphrase.Get()
+	if err != nil {
+		return err
+	}
+	hasPassphrase, err := chatHistoryHasPassphrase.Get()
+	if err != nil {
+		return err
+	}
+	if protect && !hasPassphrase && passphrase == "" {
+		return errors.New("a passphrase is required to protect the chat history")
+	}
+	if protect && passphrase != "" && len([]rune(passphrase)) < minChatHistoryPassphrase {
+		return fmt.Errorf("chat history passphrase must be at least %d characters", minChatHistoryPassphrase)
+	}
+	return nil
+}
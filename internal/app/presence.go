@@ -0,0 +1,304 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2/theme"
+	v1 "github.com/webmeshproj/api/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// presenceInterval is how often presence heartbeats are published.
+	presenceInterval = time.Second * 15
+	// presenceTTL is how long a presence heartbeat lives. A member is offline
+	// once their last heartbeat has expired.
+	presenceTTL = time.Second * 45
+	// idleTimeout is how long without input before we report ourselves idle.
+	idleTimeout = time.Minute * 5
+	// typingTTL is how long a typing marker lives.
+	typingTTL = time.Second * 5
+	// typingInterval is the least time between published typing markers.
+	typingInterval = time.Second * 3
+
+	// presenceOnline is the presence of a member using the app.
+	presenceOnline = "online"
+	// presenceIdle is the presence of a member who has not used the app for a while.
+	presenceIdle = "idle"
+	// presenceOffline is the presence of a member without a live heartbeat.
+	presenceOffline = "offline"
+)
+
+// PresencePath returns the storage path of a member's presence heartbeat.
+func PresencePath(roomName, nodeID string) string {
+	return path.Join(MembersPath(roomName), nodeID, "presence")
+}
+
+// TypingPath returns the storage path of a member's typing marker.
+func TypingPath(roomName, nodeID string) string {
+	return path.Join(MembersPath(roomName), nodeID, "typing")
+}
+
+// roomPresence tracks the presence and typing markers of the members of the selected room.
+type roomPresence struct {
+	mu sync.Mutex
+	// heartbeats are the last presence heartbeat of each member.
+	heartbeats map[string]presenceHeartbeat
+	// typing are the times members last published a typing marker.
+	typing map[string]time.Time
+}
+
+// presenceHeartbeat is a presence heartbeat received from a member.
+type presenceHeartbeat struct {
+	state string
+	at    time.Time
+}
+
+func newRoomPresence() *roomPresence {
+	return &roomPresence{
+		heartbeats: make(map[string]presenceHeartbeat),
+		typing:     make(map[string]time.Time),
+	}
+}
+
+// observe records a presence heartbeat or typing marker from a member.
+func (p *roomPresence) observe(nodeID, kind, value string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch kind {
+	case "presence":
+		p.heartbeats[nodeID] = presenceHeartbeat{state: value, at: now}
+		if value != presenceOnline {
+			delete(p.typing, nodeID)
+		}
+	case "typing":
+		p.typing[nodeID] = now
+	}
+}
+
+// clearTyping forgets a member's typing marker, such as once they send a message.
+func (p *roomPresence) clearTyping(nodeID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.typing, nodeID)
+}
+
+// state returns the presence of a member.
+func (p *roomPresence) state(nodeID string, now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hb, ok := p.heartbeats[nodeID]
+	if !ok || now.Sub(hb.at) > presenceTTL || hb.state == presenceOffline {
+		return presenceOffline
+	}
+	if hb.state == presenceIdle {
+		return presenceIdle
+	}
+	return presenceOnline
+}
+
+// typingMembers returns the members other than ourID with a live typing marker.
+func (p *roomPresence) typingMembers(ourID string, now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ids []string
+	for id, at := range p.typing {
+		if now.Sub(at) > typingTTL {
+			delete(p.typing, id)
+			continue
+		}
+		if id != ourID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// presenceColor returns the color of the status dot for a presence.
+func presenceColor(state string) color.Color {
+	switch state {
+	case presenceOnline:
+		return theme.SuccessColor()
+	case presenceIdle:
+		return theme.WarningColor()
+	default:
+		return theme.DisabledColor()
+	}
+}
+
+// ourPresence returns the presence to publish for ourself.
+func (app *App) ourPresence() string {
+	idle := time.Since(time.Unix(0, app.lastActivity.Load())) > idleTimeout
+	if idle || !app.foreground.Load() {
+		return presenceIdle
+	}
+	return presenceOnline
+}
+
+// markActive records user activity for the idle timeout.
+func (app *App) markActive() {
+	app.lastActivity.Store(time.Now().UnixNano())
+}
+
+// publishPresence publishes a presence heartbeat to a room. Heartbeats are sealed in
+// encrypted rooms, though the key still shows which node is a member.
+func (app *App) publishPresence(ctx context.Context, roomName, state string, ttl time.Duration) error {
+	ourID, _ := app.nodeID.Get()
+	key := PresencePath(roomName, ourID)
+	value, err := app.sealMessage(roomName, key, state)
+	if err != nil {
+		return err
+	}
+	return app.doPublish(ctx, &v1.PublishRequest{
+		Key:   key,
+		Value: value,
+		Ttl:   durationpb.New(ttl),
+	})
+}
+
+// runPresenceHeartbeats publishes our presence heartbeats to every joined room until
+// the context is cancelled.
+func (app *App) runPresenceHeartbeats(ctx context.Context) {
+	heartbeat := time.NewTicker(presenceInterval)
+	defer heartbeat.Stop()
+	for {
+		for _, roomName := range app.joinedRooms() {
+			if err := app.publishPresence(ctx, roomName, app.ourPresence(), presenceTTL); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if !errors.Is(err, errRoomLocked) {
+					app.log.Error("error publishing presence", "room", roomName, "error", err.Error())
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+		}
+	}
+}
+
+// runPresence publishes our presence to a room when it is opened and keeps the member
+// statuses and typing indicator current until the context is cancelled. Heartbeats
+// after the first are published by runPresenceHeartbeats.
+func (app *App) runPresence(ctx context.Context, roomName string, presence *roomPresence) {
+	refresh := time.NewTicker(time.Second)
+	defer refresh.Stop()
+	if err := app.publishPresence(ctx, roomName, app.ourPresence(), presenceTTL); err != nil && ctx.Err() == nil {
+		app.log.Error("error publishing presence", "room", roomName, "error", err.Error())
+	}
+	var ticks int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			app.updateTypingLabel(presence)
+			// Member statuses only change when heartbeats expire, so they are
+			// refreshed less often.
+			if ticks++; ticks%5 == 0 {
+				app.chatMembersList.Refresh()
+			}
+		}
+	}
+}
+
+// updateTypingLabel shows which members are typing.
+func (app *App) updateTypingLabel(presence *roomPresence) {
+	ourID, _ := app.nodeID.Get()
+	ids := presence.typingMembers(ourID, time.Now())
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i], _ = app.profiles.name(id)
+	}
+	var text string
+	switch len(names) {
+	case 0:
+	case 1:
+		text = fmt.Sprintf("%s is typing…", names[0])
+	case 2:
+		text = fmt.Sprintf("%s and %s are typing…", names[0], names[1])
+	default:
+		text = "Several people are typing…"
+	}
+	if app.typingLabel.Text != text {
+		app.typingLabel.SetText(text)
+	}
+}
+
+// onChatInputChanged publishes a typing marker to the selected room, at most once
+// every typingInterval.
+func (app *App) onChatInputChanged(s string) {
+	app.markActive()
+	roomName := app.selectedRoom
+	if s == "" || roomName == "" {
+		return
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(0, app.lastTyping.Load())) < typingInterval {
+		return
+	}
+	app.lastTyping.Store(now.UnixNano())
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		ourID, _ := app.nodeID.Get()
+		key := TypingPath(roomName, ourID)
+		value, err := app.sealMessage(roomName, key, "typing")
+		if err == nil {
+			err = app.doPublish(ctx, &v1.PublishRequest{
+				Key:   key,
+				Value: value,
+				Ttl:   durationpb.New(typingTTL),
+			})
+		}
+		if err != nil {
+			app.log.Error("error publishing typing marker", "room", roomName, "error", err.Error())
+		}
+	}()
+}
+
+// loadPresence fetches the presence heartbeats listed under a room's members path.
+func (app *App) loadPresence(ctx context.Context, cli v1.AppDaemonClient, roomName string, keys []string, presence *roomPresence) {
+	prefix := MembersPath(roomName) + "/"
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+		if len(parts) != 2 || parts[1] != "presence" {
+			continue
+		}
+		value, err := queryValue(ctx, cli, key)
+		if err != nil {
+			continue
+		}
+		if value, ok := app.openValue(key, value); ok {
+			presence.observe(parts[0], "presence", value, time.Now())
+		}
+	}
+}
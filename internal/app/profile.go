@@ -0,0 +1,368 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image/color"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"fyne.io/fyne/v2/theme"
+	v1 "github.com/webmeshproj/api/v1"
+)
+
+const (
+	// ProfilesPrefix is the prefix for user profiles.
+	ProfilesPrefix = ChatPrefix + "/profiles"
+	// maxDisplayNameLength is the longest display name allowed.
+	maxDisplayNameLength = 32
+	// maxStatusLength is the longest status text allowed.
+	maxStatusLength = 64
+)
+
+// ProfilePath returns the storage path for a node's profile.
+func ProfilePath(nodeID string) string {
+	return path.Join(ProfilesPrefix, nodeID)
+}
+
+// Profile is the user profile a node publishes for others to display.
+type Profile struct {
+	// DisplayName is the name shown in place of the node ID.
+	DisplayName string `json:"displayName,omitempty"`
+	// Status is optional status text.
+	Status string `json:"status,omitempty"`
+	// Color is the avatar color as #RRGGBB. A color derived from the node ID
+	// is used if it is empty.
+	Color string `json:"color,omitempty"`
+	// SigningKey is the Ed25519 public key the node signs its messages with.
+	SigningKey []byte `json:"signingKey,omitempty"`
+	// DirectKey is the X25519 public key used to derive the keys of direct messages with the node.
+	DirectKey []byte `json:"directKey,omitempty"`
+	// DirectKeySignature is the node's Ed25519 signature over its direct message key.
+	DirectKeySignature []byte `json:"directKeySig,omitempty"`
+}
+
+// Encode returns the profile encoded for publishing.
+func (p *Profile) Encode() (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode profile: %w", err)
+	}
+	return string(data), nil
+}
+
+// DecodeProfile decodes a published profile.
+func DecodeProfile(value string) (*Profile, error) {
+	var p Profile
+	if err := json.Unmarshal([]byte(value), &p); err != nil {
+		return nil, fmt.Errorf("failed to decode profile: %w", err)
+	}
+	p.DisplayName = limitRunes(strings.TrimSpace(p.DisplayName), maxDisplayNameLength)
+	p.Status = limitRunes(p.Status, maxStatusLength)
+	return &p, nil
+}
+
+// limitRunes returns s cut to at most n characters.
+func limitRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// parseHexColor parses a color in the form #RRGGBB.
+func parseHexColor(s string) (color.Color, error) {
+	var r, g, b uint8
+	if len(s) != 7 || s[0] != '#' {
+		return nil, fmt.Errorf("invalid color %q, expected #RRGGBB", s)
+	}
+	if _, err := fmt.Sscanf(s[1:], "%02x%02x%02x", &r, &g, &b); err != nil {
+		return nil, fmt.Errorf("invalid color %q, expected #RRGGBB", s)
+	}
+	return color.NRGBA{R: r, G: g, B: b, A: 0xff}, nil
+}
+
+// profileDirectory holds the profiles published by nodes in the mesh.
+type profileDirectory struct {
+	mu       sync.Mutex
+	profiles map[string]*Profile
+	// members are the IDs of the members of the selected room, which display names
+	// are also checked against.
+	members map[string]struct{}
+	// OnChanged is called when a profile is added, changed or removed.
+	OnChanged func()
+}
+
+// newProfileDirectory returns an empty profile directory.
+func newProfileDirectory() *profileDirectory {
+	return &profileDirectory{profiles: make(map[string]*Profile), members: make(map[string]struct{})}
+}
+
+// setMembers sets the members of the selected room and returns true if they changed.
+func (d *profileDirectory) setMembers(nodeIDs []string) bool {
+	members := make(map[string]struct{}, len(nodeIDs))
+	for _, id := range nodeIDs {
+		members[id] = struct{}{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := len(members) != len(d.members)
+	for id := range members {
+		if _, ok := d.members[id]; !ok {
+			changed = true
+		}
+	}
+	d.members = members
+	return changed
+}
+
+// set stores the profile of a node, or removes it if p is nil.
+func (d *profileDirectory) set(nodeID string, p *Profile) {
+	d.mu.Lock()
+	if p == nil {
+		delete(d.profiles, nodeID)
+	} else {
+		d.profiles[nodeID] = p
+	}
+	d.mu.Unlock()
+	if d.OnChanged != nil {
+		d.OnChanged()
+	}
+}
+
+// reset removes all profiles.
+func (d *profileDirectory) reset() {
+	d.mu.Lock()
+	d.profiles = make(map[string]*Profile)
+	d.mu.Unlock()
+	if d.OnChanged != nil {
+		d.OnChanged()
+	}
+}
+
+// name returns the name to display for a node. It is the node ID if the node has
+// not published a display name. If another node uses the same display name, or the
+// display name is the ID of another node with a profile or in the selected room, the
+// name is flagged and the node ID is appended so that one node cannot pass itself
+// off as another.
+func (d *profileDirectory) name(nodeID string) (name string, flagged bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.profiles[nodeID]
+	if !ok || p.DisplayName == "" {
+		return nodeID, false
+	}
+	for id, other := range d.profiles {
+		if id == nodeID {
+			continue
+		}
+		if strings.EqualFold(id, p.DisplayName) || strings.EqualFold(other.DisplayName, p.DisplayName) {
+			return fmt.Sprintf("%s (%s)", p.DisplayName, nodeID), true
+		}
+	}
+	for id := range d.members {
+		if id != nodeID && strings.EqualFold(id, p.DisplayName) {
+			return fmt.Sprintf("%s (%s)", p.DisplayName, nodeID), true
+		}
+	}
+	return p.DisplayName, false
+}
+
+// status returns the status text of a node.
+func (d *profileDirectory) status(nodeID string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.profiles[nodeID]; ok {
+		return p.Status
+	}
+	return ""
+}
+
+// color returns the avatar color of a node.
+func (d *profileDirectory) color(nodeID string) color.Color {
+	d.mu.Lock()
+	p, ok := d.profiles[nodeID]
+	d.mu.Unlock()
+	if ok && p.Color != "" {
+		if c, err := parseHexColor(p.Color); err == nil {
+			return c
+		}
+	}
+	names := theme.PrimaryColorNames()
+	h := fnv.New32a()
+	h.Write([]byte(nodeID))
+	return theme.PrimaryColorNamed(names[h.Sum32()%uint32(len(names))])
+}
+
+// signingKey returns the signing key a node published, or nil if it has not published one.
+func (d *profileDirectory) signingKey(nodeID string) ed25519.PublicKey {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.profiles[nodeID]; ok && len(p.SigningKey) == ed25519.PublicKeySize {
+		return p.SigningKey
+	}
+	return nil
+}
+
+// directKey returns the direct message key a node published and its signature, or
+// nil if it has not published one.
+func (d *profileDirectory) directKey(nodeID string) (key, sig []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.profiles[nodeID]; ok && len(p.DirectKey) > 0 {
+		return p.DirectKey, p.DirectKeySignature
+	}
+	return nil, nil
+}
+
+// nodeIDs returns the IDs of the nodes with profiles.
+func (d *profileDirectory) nodeIDs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make([]string, 0, len(d.profiles))
+	for id := range d.profiles {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// sortByName sorts node IDs by their display names.
+func (d *profileDirectory) sortByName(nodeIDs []string) {
+	sort.SliceStable(nodeIDs, func(i, j int) bool {
+		a, _ := d.name(nodeIDs[i])
+		b, _ := d.name(nodeIDs[j])
+		return strings.ToLower(a) < strings.ToLower(b)
+	})
+}
+
+// ourProfile returns our profile from the saved preferences.
+func (app *App) ourProfile() (*Profile, error) {
+	key, err := app.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	directKey, err := app.directKey()
+	if err != nil {
+		return nil, err
+	}
+	ourID, _ := app.nodeID.Get()
+	directPub := directKey.PublicKey().Bytes()
+	return &Profile{
+		DisplayName:        strings.TrimSpace(app.Preferences().String(preferenceDisplayName)),
+		Status:             strings.TrimSpace(app.Preferences().String(preferenceStatus)),
+		Color:              app.Preferences().String(preferenceAvatarColor),
+		SigningKey:         key.Public().(ed25519.PublicKey),
+		DirectKey:          directPub,
+		DirectKeySignature: ed25519.Sign(key, directKeyPayload(ourID, directPub)),
+	}, nil
+}
+
+// publishProfile publishes our profile to the mesh.
+func (app *App) publishProfile(ctx context.Context) error {
+	ourID, _ := app.nodeID.Get()
+	if ourID == "" {
+		return nil
+	}
+	profile, err := app.ourProfile()
+	if err != nil {
+		return err
+	}
+	value, err := profile.Encode()
+	if err != nil {
+		return err
+	}
+	err = app.doPublish(ctx, &v1.PublishRequest{
+		Key:   ProfilePath(ourID),
+		Value: value,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish profile: %w", err)
+	}
+	return nil
+}
+
+// watchProfiles loads the published profiles and subscribes to changes until the
+// context is cancelled.
+func (app *App) watchProfiles(ctx context.Context, cli v1.AppDaemonClient) {
+	stream, err := cli.Subscribe(ctx, &v1.SubscribeRequest{
+		Prefix: ProfilesPrefix,
+	})
+	if err != nil {
+		app.log.Error("error subscribing to profiles", "error", err.Error())
+		return
+	}
+	defer stream.CloseSend()
+	keys, err := queryKeys(ctx, cli, ProfilesPrefix)
+	if err != nil {
+		app.log.Error("error listing profiles", "error", err.Error())
+	}
+	for _, key := range keys {
+		value, err := queryValue(ctx, cli, key)
+		if err != nil {
+			app.log.Error("error fetching profile", "key", key, "error", err.Error())
+			continue
+		}
+		app.onProfile(key, value)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return
+			}
+			app.log.Error("error receiving profile", "error", err.Error())
+			app.metrics.subscriptionErrors.WithLabelValues("profiles").Inc()
+			return
+		}
+		app.onProfile(resp.GetKey(), resp.GetValue())
+	}
+}
+
+// onProfile stores a profile published at the given key.
+func (app *App) onProfile(key, value string) {
+	nodeID := strings.TrimPrefix(key, ProfilesPrefix+"/")
+	if nodeID == key || strings.Contains(nodeID, "/") {
+		return
+	}
+	p, err := DecodeProfile(value)
+	if err != nil {
+		app.log.Error("error decoding profile", "node", nodeID, "error", err.Error())
+		return
+	}
+	app.pinFirstKey(nodeID, p)
+	app.onInviterProfile(nodeID)
+	app.profiles.set(nodeID, p)
+	app.recordProfile(nodeID, value)
+	if slices.Contains(app.directPeers(), nodeID) {
+		ourID, _ := app.nodeID.Get()
+		if app.rooms.locked(DirectRoomName(ourID, nodeID)) {
+			if err := app.unlockDirectRoom(nodeID); err != nil {
+				app.log.Error("error unlocking direct messages", "node", nodeID, "error", err.Error())
+			}
+		}
+	}
+}
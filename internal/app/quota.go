@@ -0,0 +1,282 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	v1 "github.com/webmeshproj/api/v1"
+)
+
+const (
+	preferenceUsageDay       = "usageDay"
+	preferenceUsageDaySent   = "usageDaySent"
+	preferenceUsageDayRecv   = "usageDayRecv"
+	preferenceUsageMonth     = "usageMonth"
+	preferenceUsageMonthSent = "usageMonthSent"
+	preferenceUsageMonthRecv = "usageMonthRecv"
+	// preferenceQuotaNotified holds the highest threshold alerted for each quota in
+	// the current period, as comma separated name=percent pairs.
+	preferenceQuotaNotified = "quotaNotified"
+)
+
+// bandwidthQuota is a configured limit on transferred bytes over a period.
+type bandwidthQuota struct {
+	// name is the human readable name of the quota.
+	name string
+	// preference is the preference key holding the limit.
+	preference string
+	// used returns the bytes used against the quota.
+	used func(u *bandwidthUsage) uint64
+}
+
+// bandwidthQuotas are the quotas that can be configured in preferences.
+var bandwidthQuotas = []bandwidthQuota{
+	{"Daily send", preferenceQuotaDailySend, func(u *bandwidthUsage) uint64 { return u.daySent }},
+	{"Daily receive", preferenceQuotaDailyRecv, func(u *bandwidthUsage) uint64 { return u.dayRecv }},
+	{"Monthly send", preferenceQuotaMonthlySend, func(u *bandwidthUsage) uint64 { return u.monthSent }},
+	{"Monthly receive", preferenceQuotaMonthlyRecv, func(u *bandwidthUsage) uint64 { return u.monthRecv }},
+}
+
+// bandwidthUsage is the bytes transferred in the current day and month.
+type bandwidthUsage struct {
+	day       string
+	month     string
+	daySent   uint64
+	dayRecv   uint64
+	monthSent uint64
+	monthRecv uint64
+}
+
+// quotaAlert is raised when usage crosses a configured threshold of a quota.
+type quotaAlert struct {
+	quota     string
+	threshold int
+	used      uint64
+	limit     uint64
+}
+
+// quotaTracker accumulates bandwidth usage and checks it against the configured quotas.
+// Usage is persisted in the app preferences so it survives restarts.
+type quotaTracker struct {
+	mu       sync.Mutex
+	prefs    fyne.Preferences
+	counters interfaceCounters
+	usage    bandwidthUsage
+	// saved is the usage last persisted.
+	saved bandwidthUsage
+	// notified is the highest threshold alerted for each quota in the current period.
+	notified map[string]int
+}
+
+// newQuotaTracker returns a quota tracker restoring usage from the given preferences.
+func newQuotaTracker(prefs fyne.Preferences) *quotaTracker {
+	usage := bandwidthUsage{
+		day:       prefs.String(preferenceUsageDay),
+		month:     prefs.String(preferenceUsageMonth),
+		daySent:   prefUint(prefs, preferenceUsageDaySent),
+		dayRecv:   prefUint(prefs, preferenceUsageDayRecv),
+		monthSent: prefUint(prefs, preferenceUsageMonthSent),
+		monthRecv: prefUint(prefs, preferenceUsageMonthRecv),
+	}
+	return &quotaTracker{
+		prefs:    prefs,
+		usage:    usage,
+		saved:    usage,
+		notified: parseNotified(prefs.String(preferenceQuotaNotified)),
+	}
+}
+
+// resetBaseline forgets the last raw counters seen, so the next sample starts a new baseline.
+func (q *quotaTracker) resetBaseline() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.counters.reset()
+}
+
+// observe adds the usage since the previous sample and returns any new alerts, along
+// with whether a quota's hard cap has been reached.
+func (q *quotaTracker) observe(now time.Time, metrics *v1.InterfaceMetrics) (alerts []quotaAlert, capped bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if q.usage.day != day {
+		q.usage.day, q.usage.daySent, q.usage.dayRecv = day, 0, 0
+		q.clearNotified("Daily")
+	}
+	if q.usage.month != month {
+		q.usage.month, q.usage.monthSent, q.usage.monthRecv = month, 0, 0
+		q.clearNotified("Monthly")
+	}
+	sent, recv, _ := q.counters.delta(metrics)
+	q.usage.daySent += sent
+	q.usage.dayRecv += recv
+	q.usage.monthSent += sent
+	q.usage.monthRecv += recv
+	q.save()
+	thresholds := parseThresholds(q.prefs.StringWithFallback(preferenceQuotaThresholds, "80,90,100"))
+	for _, quota := range bandwidthQuotas {
+		limit, err := parseBytes(q.prefs.String(quota.preference))
+		if err != nil || limit == 0 {
+			continue
+		}
+		used := quota.used(&q.usage)
+		if used >= limit {
+			capped = true
+		}
+		percent := int(used * 100 / limit)
+		crossed := 0
+		for _, t := range thresholds {
+			if percent >= t {
+				crossed = t
+			}
+		}
+		if crossed > q.notified[quota.name] {
+			q.notified[quota.name] = crossed
+			alerts = append(alerts, quotaAlert{quota: quota.name, threshold: crossed, used: used, limit: limit})
+		}
+	}
+	if len(alerts) > 0 {
+		q.saveNotified()
+	}
+	return alerts, capped
+}
+
+// clearNotified forgets the alerted thresholds for quotas with the given name prefix.
+// The caller must hold the lock.
+func (q *quotaTracker) clearNotified(prefix string) {
+	var cleared bool
+	for name := range q.notified {
+		if strings.HasPrefix(name, prefix) {
+			delete(q.notified, name)
+			cleared = true
+		}
+	}
+	if cleared {
+		q.saveNotified()
+	}
+}
+
+// saveNotified persists the alerted thresholds. The caller must hold the lock.
+func (q *quotaTracker) saveNotified() {
+	pairs := make([]string, 0, len(q.notified))
+	for name, threshold := range q.notified {
+		pairs = append(pairs, name+"="+strconv.Itoa(threshold))
+	}
+	sort.Strings(pairs)
+	q.prefs.SetString(preferenceQuotaNotified, strings.Join(pairs, ","))
+}
+
+// parseNotified parses the alerted thresholds saved by saveNotified.
+func parseNotified(s string) map[string]int {
+	out := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil {
+			out[name] = n
+		}
+	}
+	return out
+}
+
+// save persists the current usage if it changed. The caller must hold the lock.
+func (q *quotaTracker) save() {
+	if q.usage == q.saved {
+		return
+	}
+	q.saved = q.usage
+	q.prefs.SetString(preferenceUsageDay, q.usage.day)
+	q.prefs.SetString(preferenceUsageMonth, q.usage.month)
+	q.prefs.SetString(preferenceUsageDaySent, strconv.FormatUint(q.usage.daySent, 10))
+	q.prefs.SetString(preferenceUsageDayRecv, strconv.FormatUint(q.usage.dayRecv, 10))
+	q.prefs.SetString(preferenceUsageMonthSent, strconv.FormatUint(q.usage.monthSent, 10))
+	q.prefs.SetString(preferenceUsageMonthRecv, strconv.FormatUint(q.usage.monthRecv, 10))
+}
+
+// checkQuotas updates bandwidth usage from the given metrics, sending notifications for
+// crossed thresholds and disconnecting if a hard cap is reached and that is enabled.
+func (app *App) checkQuotas(metrics *v1.InterfaceMetrics) {
+	alerts, capped := app.quotas.observe(time.Now(), metrics)
+	for _, alert := range alerts {
+		app.log.Info("bandwidth quota threshold reached", "quota", alert.quota, "threshold", alert.threshold)
+		app.SendNotification(fyne.NewNotification("Bandwidth Quota",
+			fmt.Sprintf("%s usage has reached %d%% (%s of %s)",
+				alert.quota, alert.threshold, bytesString(int(alert.used)), bytesString(int(alert.limit)))))
+	}
+	if capped && app.Preferences().BoolWithFallback(preferenceQuotaDisconnect, false) && app.connected.Load() {
+		app.log.Info("bandwidth quota exceeded, disconnecting from mesh")
+		app.SendNotification(fyne.NewNotification("Bandwidth Quota", "Quota exceeded, disconnecting from the mesh"))
+		app.connectState.Set(switchDisconnected)
+	}
+}
+
+// parseBytes parses a byte size such as "500MB" or "10 GB". An empty string is zero.
+func parseBytes(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	mult := uint64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   uint64
+	}{
+		{"TB", 1024 * 1024 * 1024 * 1024},
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", s)
+	}
+	return uint64(n * float64(mult)), nil
+}
+
+// parseThresholds parses a comma separated list of percentages, ignoring invalid entries.
+func parseThresholds(s string) []int {
+	var out []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(field), "%")))
+		if err != nil || n <= 0 {
+			continue
+		}
+		out = append(out, n)
+	}
+	sort.Ints(out)
+	return out
+}
+
+func prefUint(prefs fyne.Preferences, key string) uint64 {
+	n, _ := strconv.ParseUint(prefs.String(key), 10, 64)
+	return n
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	v1 "github.com/webmeshproj/api/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// preferenceReactions is the preference holding the reactions offered in the picker.
+	preferenceReactions = "reactions"
+	// defaultReactions are offered when none are configured. They are kept to
+	// characters the default theme font can render.
+	defaultReactions = "+1,-1,:),:(,<3,!"
+	// maxReactions is the most reactions that can be configured.
+	maxReactions = 12
+	// maxReactionLength is the most characters in a single reaction.
+	maxReactionLength = 16
+	// maxMessageReactions is the most distinct reactions kept for a single message.
+	maxMessageReactions = 24
+
+	// reactionAdded is the value of a reaction key while the reaction stands.
+	reactionAdded = "added"
+	// reactionRemoved is the value of a reaction key that was taken back.
+	reactionRemoved = "removed"
+	// reactionRemovedTTL is how long a removed reaction key is kept so that
+	// subscribers see the removal.
+	reactionRemovedTTL = time.Second * 30
+)
+
+// ReactionsPath returns the storage path for the reactions to a message.
+func ReactionsPath(messageKey string) string {
+	return path.Join(messageKey, "reactions")
+}
+
+// ReactionPath returns the storage path for a node's reaction to a message.
+func ReactionPath(messageKey, reaction, nodeID string) string {
+	return path.Join(ReactionsPath(messageKey), url.PathEscape(reaction), nodeID)
+}
+
+// parseReactionKey returns the message key, reaction and node ID of a reaction key.
+func parseReactionKey(key string) (messageKey, reaction, nodeID string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 4 || parts[len(parts)-3] != "reactions" {
+		return "", "", "", false
+	}
+	reaction, err := url.PathUnescape(parts[len(parts)-2])
+	if err != nil {
+		return "", "", "", false
+	}
+	return strings.Join(parts[:len(parts)-3], "/"), reaction, parts[len(parts)-1], true
+}
+
+// reactionEvent is a reaction to a message added or removed by a node.
+type reactionEvent struct {
+	messageKey string
+	reaction   string
+	nodeID     string
+	added      bool
+}
+
+// sealedReaction is the sealed value of a reaction key in an encrypted room. The key
+// only holds a token, so that the reaction and who made it are not revealed.
+type sealedReaction struct {
+	// Reaction is the reaction.
+	Reaction string `json:"reaction"`
+	// From is the ID of the node that reacted.
+	From string `json:"from"`
+	// Added is false once the reaction is taken back.
+	Added bool `json:"added"`
+}
+
+// reactionToken returns the key component of a node's reaction in an encrypted room.
+func reactionToken(roomKey []byte, reaction, nodeID string) string {
+	mac := hmac.New(sha256.New, roomKey)
+	mac.Write([]byte("webmesh reaction\x00" + reaction + "\x00" + nodeID))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// reactionKey returns the key to publish a node's reaction to a message under.
+func (app *App) reactionKey(messageKey, reaction, nodeID string) (string, error) {
+	roomName := roomFromKey(messageKey)
+	if info := app.rooms.info(roomName); info == nil || !info.Encrypted {
+		return ReactionPath(messageKey, reaction, nodeID), nil
+	}
+	roomKey := app.rooms.key(roomName)
+	if roomKey == nil {
+		return "", errRoomLocked
+	}
+	return path.Join(ReactionsPath(messageKey), reactionToken(roomKey, reaction, nodeID)), nil
+}
+
+// parseReaction returns the reaction published at a key. Only sealed reactions are
+// accepted in encrypted rooms.
+func (app *App) parseReaction(key, value string) (*reactionEvent, bool) {
+	roomName := roomFromKey(key)
+	if info := app.rooms.info(roomName); info == nil || !info.Encrypted {
+		messageKey, reaction, nodeID, ok := parseReactionKey(key)
+		if !ok || len([]rune(reaction)) > maxReactionLength {
+			return nil, false
+		}
+		return &reactionEvent{messageKey: messageKey, reaction: reaction, nodeID: nodeID, added: value == reactionAdded}, true
+	}
+	messageKey, token := path.Split(key)
+	messageKey = strings.TrimSuffix(messageKey, "/")
+	if path.Base(messageKey) != "reactions" {
+		return nil, false
+	}
+	messageKey = path.Dir(messageKey)
+	plaintext, ok := app.openValue(key, value)
+	if !ok {
+		return nil, false
+	}
+	var r sealedReaction
+	if err := json.Unmarshal([]byte(plaintext), &r); err != nil || r.Reaction == "" || r.From == "" || len([]rune(r.Reaction)) > maxReactionLength {
+		return nil, false
+	}
+	// The token binds the key to the reaction, so a reaction cannot be replayed under
+	// another node's key.
+	if roomKey := app.rooms.key(roomName); roomKey == nil || !hmac.Equal([]byte(token), []byte(reactionToken(roomKey, r.Reaction, r.From))) {
+		return nil, false
+	}
+	return &reactionEvent{messageKey: messageKey, reaction: r.Reaction, nodeID: r.From, added: r.Added}, true
+}
+
+// parseReactions splits a comma separated list of reactions.
+func parseReactions(s string) []string {
+	var out []string
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r != "" && !slices.Contains(out, r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// reactionCount is the number of nodes that reacted to a message with a reaction.
+type reactionCount struct {
+	reaction string
+	nodeIDs  []string
+}
+
+// summarizeReactions returns the reactions to a message, most popular first.
+func summarizeReactions(reactions map[string]map[string]struct{}) []reactionCount {
+	out := make([]reactionCount, 0, len(reactions))
+	for reaction, nodes := range reactions {
+		if len(nodes) == 0 {
+			continue
+		}
+		rc := reactionCount{reaction: reaction}
+		for nodeID := range nodes {
+			rc.nodeIDs = append(rc.nodeIDs, nodeID)
+		}
+		sort.Strings(rc.nodeIDs)
+		out = append(out, rc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].nodeIDs) != len(out[j].nodeIDs) {
+			return len(out[i].nodeIDs) > len(out[j].nodeIDs)
+		}
+		return out[i].reaction < out[j].reaction
+	})
+	return out
+}
+
+// reactionsText returns the reaction counts shown below a message.
+func reactionsText(reactions []reactionCount) string {
+	parts := make([]string, len(reactions))
+	for i, rc := range reactions {
+		parts[i] = fmt.Sprintf("%s %d", rc.reaction, len(rc.nodeIDs))
+	}
+	return strings.Join(parts, "   ")
+}
+
+// reacted returns true if a node is among those that reacted to an entry with a reaction.
+func (e *chatEntry) reacted(reaction, nodeID string) bool {
+	for _, rc := range e.reactions {
+		if rc.reaction == reaction {
+			return slices.Contains(rc.nodeIDs, nodeID)
+		}
+	}
+	return false
+}
+
+// reactionSet returns the reactions offered in the picker.
+func (app *App) reactionSet() []string {
+	if set := parseReactions(app.Preferences().String(preferenceReactions)); len(set) > 0 {
+		return set
+	}
+	return parseReactions(defaultReactions)
+}
+
+// reactionMenu returns the reaction picker for an entry. Reactions we have made are
+// checked, and choosing one adds or removes it.
+func (app *App) reactionMenu(e *chatEntry) *fyne.Menu {
+	if e.message == nil || e.deleted() {
+		return nil
+	}
+	ourID, _ := app.nodeID.Get()
+	// Reactions outside the configured set are only offered to take back our own.
+	reactions := app.reactionSet()
+	for _, rc := range e.reactions {
+		if !slices.Contains(reactions, rc.reaction) && slices.Contains(rc.nodeIDs, ourID) {
+			reactions = append(reactions, rc.reaction)
+		}
+	}
+	menu := fyne.NewMenu("")
+	for _, reaction := range reactions {
+		reaction := reaction
+		item := fyne.NewMenuItem(reaction, func() {
+			go app.toggleReaction(e, reaction)
+		})
+		item.Checked = e.reacted(reaction, ourID)
+		menu.Items = append(menu.Items, item)
+	}
+	return menu
+}
+
+// toggleReaction adds our reaction to a message, or removes it if we already made it.
+// Reactions are sealed in encrypted rooms.
+func (app *App) toggleReaction(e *chatEntry, reaction string) {
+	ourID, _ := app.nodeID.Get()
+	roomName := roomFromKey(e.key)
+	added := !e.reacted(reaction, ourID)
+	key, err := app.reactionKey(e.key, reaction, ourID)
+	if err != nil {
+		dialog.ShowError(fmt.Errorf("failed to react to message: %w", err), app.main)
+		return
+	}
+	value := reactionAdded
+	if !added {
+		value = reactionRemoved
+	}
+	if info := app.rooms.info(roomName); info != nil && info.Encrypted {
+		data, err := json.Marshal(&sealedReaction{Reaction: reaction, From: ourID, Added: added})
+		if err != nil {
+			app.log.Error("error encoding reaction", "error", err.Error())
+			return
+		}
+		if value, err = app.sealMessage(roomName, key, string(data)); err != nil {
+			dialog.ShowError(fmt.Errorf("failed to react to message: %w", err), app.main)
+			return
+		}
+	}
+	req := &v1.PublishRequest{Key: key, Value: value}
+	if !added {
+		req.Ttl = durationpb.New(reactionRemovedTTL)
+	} else if info := app.rooms.info(roomName); info != nil && info.ttl() > 0 {
+		req.Ttl = durationpb.New(info.ttl())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := app.doPublish(ctx, req); err != nil {
+		app.log.Error("error publishing reaction", "error", err.Error())
+		dialog.ShowError(fmt.Errorf("failed to react to message: %w", err), app.main)
+	}
+}
+
+// loadReactions fetches stored reactions and adds them to the transcript.
+func (app *App) loadReactions(ctx context.Context, cli v1.AppDaemonClient, transcript *chatTranscript, keys []string) {
+	for _, key := range keys {
+		value, err := queryValue(ctx, cli, key)
+		if err != nil {
+			app.log.Error("error fetching reaction", "key", key, "error", err.Error())
+			continue
+		}
+		if r, ok := app.parseReaction(key, value); ok {
+			transcript.react(r)
+		}
+	}
+	app.renderTranscript(transcript)
+}
@@ -0,0 +1,387 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	v1 "github.com/webmeshproj/api/v1"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// RoomInfoVersion is the current version of the room info published at a room's path.
+	RoomInfoVersion = 1
+	// ContentTypeLocked is the content type of encrypted messages that could not be opened.
+	ContentTypeLocked = "application/x-webmesh-locked"
+	// roomKeyCheck is sealed with a room's key so that keys can be checked before use.
+	roomKeyCheck = "webmesh room key check"
+	// preferenceRoomKeyPrefix prefixes the preferences holding the keys of encrypted rooms.
+	preferenceRoomKeyPrefix = "roomKey."
+)
+
+// errRoomLocked is returned when a room is encrypted and we do not have its key.
+var errRoomLocked = errors.New("room is encrypted and the key is not known")
+
+// RoomInfo is published as the value of a room's path. Rooms published without
+// a value are public and never expire.
+type RoomInfo struct {
+	// Version is the version of the room info.
+	Version int `json:"v"`
+	// TTL is how long the room and its contents live, or empty for forever.
+	TTL string `json:"ttl,omitempty"`
+	// Encrypted is true if messages in the room are sealed with the room key.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Direct is true for direct messages between two nodes. The room key is derived
+	// from the nodes' direct message keys.
+	Direct bool `json:"direct,omitempty"`
+	// Salt is the salt used to derive the room key from its passphrase.
+	Salt []byte `json:"salt,omitempty"`
+	// Check is a known value sealed with the room key.
+	Check string `json:"check,omitempty"`
+}
+
+// DecodeRoomInfo decodes the value published at a room's path.
+func DecodeRoomInfo(value string) (*RoomInfo, error) {
+	var info RoomInfo
+	if strings.TrimSpace(value) == "" {
+		return &info, nil
+	}
+	if err := json.Unmarshal([]byte(value), &info); err != nil {
+		return nil, fmt.Errorf("failed to decode room info: %w", err)
+	}
+	return &info, nil
+}
+
+// Encode returns the room info encoded for publishing.
+func (info *RoomInfo) Encode() (string, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode room info: %w", err)
+	}
+	return string(data), nil
+}
+
+// ttl returns the lifetime of the room, or zero for forever.
+func (info *RoomInfo) ttl() time.Duration {
+	d, _ := time.ParseDuration(info.TTL)
+	return d
+}
+
+// newEncryptedRoomInfo returns the info for a new encrypted room and its key.
+func newEncryptedRoomInfo(roomName, passphrase string, ttl time.Duration) (*RoomInfo, []byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	key := deriveRoomKey(passphrase, salt)
+	check, err := sealRoomValue(key, []byte(roomKeyCheck), RoomPath(roomName))
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &RoomInfo{
+		Version:   RoomInfoVersion,
+		Encrypted: true,
+		Salt:      salt,
+		Check:     check,
+	}
+	if ttl > 0 {
+		info.TTL = ttl.String()
+	}
+	return info, key, nil
+}
+
+// deriveRoomKey derives a room key from a passphrase with Argon2id.
+func deriveRoomKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, chacha20poly1305.KeySize)
+}
+
+// checkRoomKey returns an error if the key is not the key of the room.
+func checkRoomKey(roomName string, info *RoomInfo, key []byte) error {
+	check, err := openRoomValue(key, info.Check, RoomPath(roomName))
+	if err != nil || subtle.ConstantTimeCompare(check, []byte(roomKeyCheck)) != 1 {
+		return errors.New("incorrect room passphrase")
+	}
+	return nil
+}
+
+// sealRoomValue seals a value with XChaCha20-Poly1305 bound to the key it is published
+// under, and returns the nonce and ciphertext base64 encoded.
+func sealRoomValue(key, plaintext []byte, storageKey string) (string, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cipher: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(storageKey))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openRoomValue opens a value sealed with sealRoomValue.
+func openRoomValue(key []byte, sealed, storageKey string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sealed value: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(storageKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed value: %w", err)
+	}
+	return plaintext, nil
+}
+
+// sealedMessage is published in place of a message envelope, or another value such
+// as a presence heartbeat, in encrypted rooms.
+type sealedMessage struct {
+	Version int    `json:"v"`
+	Sealed  string `json:"sealed"`
+}
+
+// roomDirectory holds the info of known rooms and the keys of encrypted ones.
+type roomDirectory struct {
+	mu    sync.Mutex
+	infos map[string]*RoomInfo
+	keys  map[string][]byte
+}
+
+func newRoomDirectory() *roomDirectory {
+	return &roomDirectory{
+		infos: make(map[string]*RoomInfo),
+		keys:  make(map[string][]byte),
+	}
+}
+
+// info returns the info of a room, or nil if it is not known.
+func (d *roomDirectory) info(roomName string) *RoomInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.infos[roomName]
+}
+
+// key returns the key of an encrypted room, or nil if it is not known.
+func (d *roomDirectory) key(roomName string) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.keys[roomName]
+}
+
+// locked returns true if the room is encrypted and we do not have its key.
+func (d *roomDirectory) locked(roomName string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info, ok := d.infos[roomName]
+	return ok && info.Encrypted && d.keys[roomName] == nil
+}
+
+// setRoomInfo stores the info of a room along with the saved key if it opens the room.
+// Info that would change how a known room is encrypted, or that the saved key does not
+// open, is ignored so that nobody can downgrade or take over a room by republishing it.
+func (app *App) setRoomInfo(roomName string, info *RoomInfo) {
+	saved := app.savedRoomKey(roomName)
+	if err := checkRoomInfoChange(roomName, app.rooms.info(roomName), info, saved); err != nil {
+		app.log.Warn("ignoring room info", "room", roomName, "error", err.Error())
+		return
+	}
+	var key []byte
+	if info.Encrypted && saved != nil {
+		key = saved
+	}
+	app.rooms.mu.Lock()
+	app.rooms.infos[roomName] = info
+	if key != nil {
+		app.rooms.keys[roomName] = key
+	} else {
+		delete(app.rooms.keys, roomName)
+	}
+	app.rooms.mu.Unlock()
+	app.recordRoom(roomName, info)
+}
+
+// checkRoomInfoChange returns an error if the info published for a room changes
+// whether or how it is encrypted from the info already known, or if it is not opened
+// by the key saved for the room.
+func checkRoomInfoChange(roomName string, prev, next *RoomInfo, savedKey []byte) error {
+	if prev != nil && (prev.Encrypted != next.Encrypted || prev.Direct != next.Direct || prev.Check != next.Check) {
+		return errors.New("room encryption changed")
+	}
+	if savedKey != nil {
+		if !next.Encrypted {
+			return errors.New("room is no longer encrypted")
+		}
+		if err := checkRoomKey(roomName, next, savedKey); err != nil {
+			return errors.New("room key changed")
+		}
+	}
+	return nil
+}
+
+// savedRoomKey returns the key saved for an encrypted room, or nil if none is saved.
+func (app *App) savedRoomKey(roomName string) []byte {
+	key, err := base64.StdEncoding.DecodeString(app.Preferences().String(preferenceRoomKeyPrefix + roomName))
+	if err != nil || len(key) == 0 {
+		return nil
+	}
+	return key
+}
+
+// forgetRoom drops the info and saved key of a room before it is created again.
+func (app *App) forgetRoom(roomName string) {
+	app.rooms.mu.Lock()
+	delete(app.rooms.infos, roomName)
+	delete(app.rooms.keys, roomName)
+	app.rooms.mu.Unlock()
+	app.Preferences().SetString(preferenceRoomKeyPrefix+roomName, "")
+}
+
+// setRoomKey stores and saves the key of an encrypted room.
+func (app *App) setRoomKey(roomName string, key []byte) {
+	app.rooms.mu.Lock()
+	app.rooms.keys[roomName] = key
+	app.rooms.mu.Unlock()
+	app.Preferences().SetString(preferenceRoomKeyPrefix+roomName, base64.StdEncoding.EncodeToString(key))
+}
+
+// fetchRoomInfo fetches and stores the info of a room.
+func (app *App) fetchRoomInfo(ctx context.Context, cli v1.AppDaemonClient, roomName string) (*RoomInfo, error) {
+	value, err := queryValue(ctx, cli, RoomPath(roomName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch room info: %w", err)
+	}
+	info, err := DecodeRoomInfo(value)
+	if err != nil {
+		return nil, err
+	}
+	app.setRoomInfo(roomName, info)
+	return info, nil
+}
+
+// unlockRoom asks for the passphrase of an encrypted room and calls done with
+// true once the room is unlocked.
+func (app *App) unlockRoom(roomName string, done func(bool)) {
+	info := app.rooms.info(roomName)
+	if info == nil || !info.Encrypted {
+		done(true)
+		return
+	}
+	passphrase := widget.NewPasswordEntry()
+	dialog.ShowForm(fmt.Sprintf("Unlock %s", roomName), "Unlock", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Passphrase", passphrase),
+	}, func(ok bool) {
+		if !ok {
+			done(false)
+			return
+		}
+		key := deriveRoomKey(passphrase.Text, info.Salt)
+		if err := checkRoomKey(roomName, info, key); err != nil {
+			dialog.ShowError(err, app.main)
+			done(false)
+			return
+		}
+		app.setRoomKey(roomName, key)
+		app.roomsListWidget.Refresh()
+		done(true)
+	}, app.main)
+}
+
+// sealMessage returns the value to publish for an encoded message in a room,
+// sealing it if the room is encrypted or a key is saved for it.
+func (app *App) sealMessage(roomName, key, value string) (string, error) {
+	info := app.rooms.info(roomName)
+	if (info == nil || !info.Encrypted) && app.savedRoomKey(roomName) == nil {
+		return value, nil
+	}
+	roomKey := app.rooms.key(roomName)
+	if roomKey == nil {
+		return "", errRoomLocked
+	}
+	sealed, err := sealRoomValue(roomKey, []byte(value), key)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&sealedMessage{Version: ChatMessageVersion, Sealed: sealed})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode sealed message: %w", err)
+	}
+	return string(data), nil
+}
+
+// openMessage decodes a message published in a room, opening it if it is sealed.
+// Sealed messages that cannot be opened, and messages in encrypted rooms that are
+// not sealed, are returned with ContentTypeLocked.
+func (app *App) openMessage(key, value string) *ChatMessage {
+	plaintext, ok := app.openValue(key, value)
+	if !ok {
+		locked := DecodeChatMessage(key, "")
+		locked.ContentType = ContentTypeLocked
+		return locked
+	}
+	return DecodeChatMessage(key, plaintext)
+}
+
+// openValue returns a value published in a room, opening it if it is sealed. It
+// returns false for sealed values that cannot be opened and for values in encrypted
+// rooms that are not sealed.
+func (app *App) openValue(key, value string) (string, bool) {
+	roomName := roomFromKey(key)
+	var sealed sealedMessage
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") || json.Unmarshal([]byte(value), &sealed) != nil || sealed.Sealed == "" {
+		if info := app.rooms.info(roomName); info != nil && info.Encrypted {
+			// Anyone can publish to the room, so only sealed values are trusted.
+			app.log.Warn("ignoring unsealed value in encrypted room", "key", key)
+			return "", false
+		}
+		return value, true
+	}
+	roomKey := app.rooms.key(roomName)
+	if roomKey == nil {
+		return "", false
+	}
+	plaintext, err := openRoomValue(roomKey, sealed.Sealed, key)
+	if err != nil {
+		app.log.Error("error opening value", "key", key, "error", err.Error())
+		return "", false
+	}
+	return string(plaintext), true
+}
+
+// roomFromKey returns the name of the room a storage key belongs to.
+func roomFromKey(key string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(key, RoomsPrefix+"/"), "/")
+	return name
+}
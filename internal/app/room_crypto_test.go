@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"fyne.io/fyne/v2/test"
+)
+
+// newTestRoomApp returns an app with an encrypted room and its saved key.
+func newTestRoomApp(t *testing.T, roomName string) (*App, *RoomInfo, []byte) {
+	app := &App{App: test.NewApp(), rooms: newRoomDirectory(), log: slog.Default()}
+	info, key, err := newEncryptedRoomInfo(roomName, "correct horse battery", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.setRoomInfo(roomName, info)
+	app.setRoomKey(roomName, key)
+	t.Cleanup(func() { app.forgetRoom(roomName) })
+	return app, info, key
+}
+
+func TestSealOpenRoomValue(t *testing.T) {
+	key := deriveRoomKey("correct horse battery", []byte("salt"))
+	sealed, err := sealRoomValue(key, []byte("hello"), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := openRoomValue(key, sealed, "/a")
+	if err != nil || string(plaintext) != "hello" {
+		t.Fatalf("opened %q, %v", plaintext, err)
+	}
+	if _, err := openRoomValue(key, sealed, "/b"); err == nil {
+		t.Fatal("opened a value moved to another key")
+	}
+	if _, err := openRoomValue(deriveRoomKey("wrong", []byte("salt")), sealed, "/a"); err == nil {
+		t.Fatal("opened a value with the wrong key")
+	}
+}
+
+func TestSealOpenMessage(t *testing.T) {
+	app, _, _ := newTestRoomApp(t, "secret")
+	msg, err := NewChatMessage("node", ContentTypeText, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewMessageKey("secret", "node")
+	sealed, err := app.sealMessage("secret", key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed == value {
+		t.Fatal("message was not sealed")
+	}
+	if got := app.openMessage(key, sealed); got.Body != "hello" {
+		t.Fatalf("opened %+v", got)
+	}
+	if got := app.openMessage(key, value); got.ContentType != ContentTypeLocked {
+		t.Fatalf("unsealed message in encrypted room opened as %+v", got)
+	}
+}
+
+func TestRoomInfoDowngrade(t *testing.T) {
+	app, info, key := newTestRoomApp(t, "secret")
+	app.setRoomInfo("secret", &RoomInfo{Version: RoomInfoVersion})
+	if got := app.rooms.info("secret"); got != info {
+		t.Fatalf("room info downgraded to %+v", got)
+	}
+	other, _, err := newEncryptedRoomInfo("secret", "another passphrase", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.setRoomInfo("secret", other)
+	if got := app.rooms.info("secret"); got != info {
+		t.Fatalf("room check replaced with %+v", got)
+	}
+	// The saved key still pins the room once its info is forgotten.
+	app.rooms.mu.Lock()
+	delete(app.rooms.infos, "secret")
+	app.rooms.mu.Unlock()
+	app.setRoomInfo("secret", &RoomInfo{Version: RoomInfoVersion})
+	if got := app.rooms.info("secret"); got != nil {
+		t.Fatalf("room info downgraded to %+v", got)
+	}
+	if sealed, err := app.sealMessage("secret", NewMessageKey("secret", "node"), "hello"); err != nil || sealed == "hello" {
+		t.Fatalf("sealed %q, %v", sealed, err)
+	}
+	app.setRoomInfo("secret", info)
+	if got := app.rooms.key("secret"); string(got) != string(key) {
+		t.Fatal("saved key not restored")
+	}
+}
+
+func TestSealedReaction(t *testing.T) {
+	app, _, _ := newTestRoomApp(t, "secret")
+	messageKey := NewMessageKey("secret", "author")
+	key, err := app.reactionKey(messageKey, "+1", "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(key, "node") || strings.Contains(key, "+1") {
+		t.Fatalf("reaction key %s reveals the reaction", key)
+	}
+	data, err := json.Marshal(&sealedReaction{Reaction: "+1", From: "node", Added: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := app.sealMessage("secret", key, string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := app.parseReaction(key, value)
+	if !ok || r.messageKey != messageKey || r.reaction != "+1" || r.nodeID != "node" || !r.added {
+		t.Fatalf("parsed %+v, %v", r, ok)
+	}
+	// A reaction claiming another node does not match the key's token.
+	data, _ = json.Marshal(&sealedReaction{Reaction: "+1", From: "other", Added: true})
+	value, _ = app.sealMessage("secret", key, string(data))
+	if _, ok := app.parseReaction(key, value); ok {
+		t.Fatal("accepted a reaction replayed under another node's key")
+	}
+	if _, ok := app.parseReaction(ReactionPath(messageKey, "+1", "node"), reactionAdded); ok {
+		t.Fatal("accepted an unsealed reaction in an encrypted room")
+	}
+	long := strings.Repeat("x", maxReactionLength+1)
+	key, _ = app.reactionKey(messageKey, long, "node")
+	data, _ = json.Marshal(&sealedReaction{Reaction: long, From: "node", Added: true})
+	value, _ = app.sealMessage("secret", key, string(data))
+	if _, ok := app.parseReaction(key, value); ok {
+		t.Fatal("accepted a reaction longer than the limit")
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	// searchPanelWidth is the width of the search side panel.
+	searchPanelWidth = 320
+	// searchDateLayout is the layout of the dates in the search filters.
+	searchDateLayout = "2006-01-02"
+	// searchAllRooms and searchAnyone are the filter options that match everything.
+	searchAllRooms = "All rooms"
+	searchAnyone   = "Anyone"
+	// searchDebounce is how long typing in the search box must pause before searching.
+	searchDebounce = 250 * time.Millisecond
+)
+
+// newSearchPanel returns the side panel for searching the messages in joined rooms.
+func (app *App) newSearchPanel() fyne.CanvasObject {
+	var results []*searchDoc
+	rooms := map[string]string{}
+	senders := map[string]string{}
+	query := widget.NewEntry()
+	query.SetPlaceHolder("Search messages")
+	roomSelect := widget.NewSelect(nil, nil)
+	senderSelect := widget.NewSelect(nil, nil)
+	since := widget.NewEntry()
+	since.SetPlaceHolder(searchDateLayout)
+	since.Validator = validateSearchDate
+	until := widget.NewEntry()
+	until.SetPlaceHolder(searchDateLayout)
+	until.Validator = validateSearchDate
+	status := widget.NewLabel("")
+	// The results are replaced by searches that finish on the debounce timer, so they
+	// are guarded. The filters are only read and replaced on the UI goroutine.
+	var mu sync.Mutex
+	var generation int
+	result := func(id widget.ListItemID) (*searchDoc, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if id < 0 || id >= len(results) {
+			return nil, false
+		}
+		return results[id], true
+	}
+	list := widget.NewList(
+		func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(results)
+		},
+		func() fyne.CanvasObject {
+			header := widget.NewLabel("")
+			header.TextStyle = fyne.TextStyle{Bold: true}
+			body := widget.NewLabel("")
+			body.Wrapping = fyne.TextTruncate
+			return container.New(layout.NewVBoxLayout(), header, body)
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			doc, ok := result(id)
+			if !ok {
+				return
+			}
+			labels := obj.(*fyne.Container).Objects
+			name, _ := app.profiles.name(doc.from)
+			labels[0].(*widget.Label).SetText(truncate(app.roomTitle(doc.room), 20) + " · " + truncate(name, 20) + " · " + chatTimeString(doc.time))
+			labels[1].(*widget.Label).SetText(strings.Join(strings.Fields(doc.text), " "))
+		},
+	)
+	// current returns the query in the search box and filters.
+	current := func() searchQuery {
+		q := searchQuery{
+			text: query.Text,
+			room: rooms[roomSelect.Selected],
+			from: senders[senderSelect.Selected],
+		}
+		if t, err := time.ParseInLocation(searchDateLayout, since.Text, time.Local); err == nil {
+			q.since = t
+		}
+		if t, err := time.ParseInLocation(searchDateLayout, until.Text, time.Local); err == nil {
+			q.until = t.AddDate(0, 0, 1)
+		}
+		return q
+	}
+	run := func(q searchQuery) {
+		mu.Lock()
+		generation++
+		gen := generation
+		mu.Unlock()
+		found := app.search.search(q)
+		mu.Lock()
+		if gen != generation {
+			// A newer search has started.
+			mu.Unlock()
+			return
+		}
+		results = found
+		mu.Unlock()
+		switch {
+		case strings.TrimSpace(q.text) == "":
+			status.SetText("")
+		case len(found) == 1:
+			status.SetText("1 result")
+		case len(found) == maxSearchResults:
+			status.SetText("Showing the newest results")
+		default:
+			status.SetText(fmt.Sprintf("%d results", len(found)))
+		}
+		list.UnselectAll()
+		list.Refresh()
+	}
+	// Searches run once typing pauses rather than on every key. Changing a filter
+	// searches at once, replacing any pending search.
+	var debounce *time.Timer
+	search := func() {
+		if debounce != nil {
+			debounce.Stop()
+		}
+		run(current())
+	}
+	query.OnChanged = func(string) {
+		if debounce != nil {
+			debounce.Stop()
+		}
+		q := current()
+		debounce = time.AfterFunc(searchDebounce, func() { run(q) })
+	}
+	roomSelect.OnChanged = func(string) { search() }
+	senderSelect.OnChanged = func(string) { search() }
+	since.OnChanged = func(string) { search() }
+	until.OnChanged = func(string) { search() }
+	list.OnSelected = func(id widget.ListItemID) {
+		if doc, ok := result(id); ok {
+			app.jumpToMessage(doc.room, doc.key)
+		}
+	}
+	// The filters are refreshed each time the panel is shown.
+	app.refreshSearchFilters = func() {
+		rooms = map[string]string{searchAllRooms: ""}
+		roomOptions := []string{searchAllRooms}
+		for _, roomName := range app.joinedRooms() {
+			label := app.roomTitle(roomName)
+			rooms[label] = roomName
+			roomOptions = append(roomOptions, label)
+		}
+		senders = map[string]string{searchAnyone: ""}
+		senderIDs := app.search.senders()
+		app.profiles.sortByName(senderIDs)
+		senderOptions := []string{searchAnyone}
+		for _, id := range senderIDs {
+			name, _ := app.profiles.name(id)
+			if _, ok := senders[name]; ok {
+				name += " (" + truncate(id, 12) + ")"
+			}
+			senders[name] = id
+			senderOptions = append(senderOptions, name)
+		}
+		roomSelect.Options = roomOptions
+		if !slices.Contains(roomOptions, roomSelect.Selected) {
+			roomSelect.SetSelected(searchAllRooms)
+		}
+		senderSelect.Options = senderOptions
+		if !slices.Contains(senderOptions, senderSelect.Selected) {
+			senderSelect.SetSelected(searchAnyone)
+		}
+		roomSelect.Refresh()
+		senderSelect.Refresh()
+		search()
+	}
+	// The spacer gives the panel its width.
+	spacer := canvas.NewRectangle(theme.BackgroundColor())
+	spacer.SetMinSize(fyne.NewSize(searchPanelWidth, 0))
+	closeButton := widget.NewButtonWithIcon("", theme.CancelIcon(), app.toggleSearch)
+	title := container.New(layout.NewBorderLayout(nil, nil, nil, closeButton), closeButton, widget.NewLabel("Search"))
+	filters := container.New(layout.NewFormLayout(),
+		widget.NewLabel("Room"), roomSelect,
+		widget.NewLabel("From"), senderSelect,
+		widget.NewLabel("Since"), since,
+		widget.NewLabel("Until"), until,
+	)
+	top := container.New(layout.NewVBoxLayout(), spacer, title, query, filters, status)
+	separator := widget.NewSeparator()
+	app.searchPanel = container.New(layout.NewBorderLayout(top, nil, separator, nil), top, separator, list)
+	app.searchPanel.Hide()
+	return app.searchPanel
+}
+
+// toggleSearch shows or hides the search side panel.
+func (app *App) toggleSearch() {
+	if app.searchPanel.Visible() {
+		app.searchPanel.Hide()
+	} else {
+		app.refreshSearchFilters()
+		app.searchPanel.Show()
+	}
+	app.chatContainer.Refresh()
+}
+
+// jumpToMessage opens a room scrolled to the message at a key.
+func (app *App) jumpToMessage(roomName, key string) {
+	if roomName == app.selectedRoom {
+		if app.chatView.ScrollToKey(key) {
+			return
+		}
+		// Reopen the room around the message.
+		app.cancelRoomSubscription()
+		app.jumpTo = key
+		app.openRoom(roomName)
+		return
+	}
+	app.jumpTo = key
+	if rooms, _ := app.roomsList.Get(); slices.Contains(rooms, roomName) {
+		app.roomsListWidget.Select(slices.Index(rooms, roomName))
+		return
+	}
+	if peerID := app.directPeerForRoom(roomName); peerID != "" {
+		peers, _ := app.directList.Get()
+		if i := slices.Index(peers, peerID); i >= 0 {
+			app.directListWidget.Select(i)
+			return
+		}
+	}
+	app.jumpTo = ""
+}
+
+// validateSearchDate checks a date filter is empty or a valid date.
+func validateSearchDate(s string) error {
+	if s == "" {
+		return nil
+	}
+	if _, err := time.Parse(searchDateLayout, s); err != nil {
+		return errors.New("dates must be formatted as " + searchDateLayout)
+	}
+	return nil
+}
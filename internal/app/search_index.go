@@ -0,0 +1,287 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	v1 "github.com/webmeshproj/api/v1"
+)
+
+// maxSearchResults is the most results returned by a search.
+const maxSearchResults = 200
+
+// searchDoc is an indexed message.
+type searchDoc struct {
+	key  string
+	room string
+	id   string
+	from string
+	time time.Time
+	text string
+	// message is the original message, for checking revisions of it.
+	message *ChatMessage
+	// terms are the terms the message is indexed under, for removing it.
+	terms []string
+}
+
+// searchQuery is a full-text search with optional filters.
+type searchQuery struct {
+	text string
+	// room limits results to a room if set.
+	room string
+	// from limits results to a sender if set.
+	from string
+	// since and until limit results to a time range if set.
+	since time.Time
+	until time.Time
+}
+
+// searchIndex is an in-memory inverted index of the messages the app has seen.
+type searchIndex struct {
+	mu   sync.RWMutex
+	docs map[string]*searchDoc
+	// ids maps message IDs to the keys they were published at.
+	ids map[string]string
+	// postings maps terms to the keys of the messages containing them.
+	postings map[string]map[string]struct{}
+	// terms are the terms in postings, sorted for prefix lookups.
+	terms []string
+	// deleted are the keys of deleted messages, so they are not indexed again.
+	deleted map[string]struct{}
+	// honor optionally decides if a revision from the original sender is applied,
+	// as for the transcript.
+	honor func(original, revision *chatEntry) bool
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:     make(map[string]*searchDoc),
+		ids:      make(map[string]string),
+		postings: make(map[string]map[string]struct{}),
+		deleted:  make(map[string]struct{}),
+	}
+}
+
+// searchTerms splits text into lower case terms.
+func searchTerms(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]struct{}, len(fields))
+	terms := fields[:0]
+	for _, f := range fields {
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		seen[f] = struct{}{}
+		terms = append(terms, f)
+	}
+	return terms
+}
+
+// has returns true if the message at a key is indexed or was deleted.
+func (s *searchIndex) has(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.docs[key]
+	_, deleted := s.deleted[key]
+	return ok || deleted
+}
+
+// add indexes a message published at a key. Edits replace the text of the message
+// they revise and deletions remove it, if they are honored as in the transcript.
+// Messages that could not be decrypted are not indexed.
+func (s *searchIndex) add(key string, msg *ChatMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deleted[key]; ok {
+		return
+	}
+	if msg.Replaces != "" {
+		orig, ok := s.docs[s.ids[msg.Replaces]]
+		if !ok || !s.honored(orig, key, msg) {
+			return
+		}
+		if msg.ContentType == ContentTypeTombstone {
+			s.remove(orig)
+			s.deleted[orig.key] = struct{}{}
+			return
+		}
+		s.index(&searchDoc{key: orig.key, room: orig.room, id: orig.id, from: orig.from, time: orig.time, text: msg.displayText(), message: orig.message})
+		return
+	}
+	if _, ok := s.docs[key]; ok {
+		return
+	}
+	if !strings.HasPrefix(msg.ContentType, "text/") && msg.ContentType != ContentTypeAttachment {
+		return
+	}
+	_, t := parseMessageKey(key)
+	if t.IsZero() {
+		t = msg.SentAt
+	}
+	s.index(&searchDoc{key: key, room: roomFromKey(key), id: msg.ID, from: msg.From, time: t, text: msg.displayText(), message: msg})
+}
+
+// honored returns true if a revision published at a key was published by the sender
+// of the original message and passes the honor check. The caller must hold the lock.
+func (s *searchIndex) honored(orig *searchDoc, key string, rev *ChatMessage) bool {
+	origFrom, _ := parseMessageKey(orig.key)
+	revFrom, _ := parseMessageKey(key)
+	if rev.From != orig.from || origFrom != orig.from || revFrom != rev.From {
+		return false
+	}
+	return s.honor == nil || s.honor(&chatEntry{key: orig.key, message: orig.message}, &chatEntry{key: key, message: rev})
+}
+
+// index adds a document, replacing any at the same key. The caller must hold the lock.
+func (s *searchIndex) index(doc *searchDoc) {
+	if old, ok := s.docs[doc.key]; ok {
+		s.remove(old)
+	}
+	doc.terms = searchTerms(doc.text)
+	for _, term := range doc.terms {
+		keys, ok := s.postings[term]
+		if !ok {
+			keys = make(map[string]struct{})
+			s.postings[term] = keys
+			i, _ := slices.BinarySearch(s.terms, term)
+			s.terms = slices.Insert(s.terms, i, term)
+		}
+		keys[doc.key] = struct{}{}
+	}
+	s.docs[doc.key] = doc
+	s.ids[doc.id] = doc.key
+}
+
+// remove drops a document. The caller must hold the lock.
+func (s *searchIndex) remove(doc *searchDoc) {
+	for _, term := range doc.terms {
+		delete(s.postings[term], doc.key)
+		if len(s.postings[term]) == 0 {
+			delete(s.postings, term)
+			if i, ok := slices.BinarySearch(s.terms, term); ok {
+				s.terms = slices.Delete(s.terms, i, i+1)
+			}
+		}
+	}
+	delete(s.docs, doc.key)
+}
+
+// senders returns the IDs of the nodes that sent indexed messages.
+func (s *searchIndex) senders() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := make(map[string]struct{})
+	var out []string
+	for _, doc := range s.docs {
+		if _, ok := seen[doc.from]; !ok {
+			seen[doc.from] = struct{}{}
+			out = append(out, doc.from)
+		}
+	}
+	return out
+}
+
+// search returns the messages matching a query, newest first. Every term in the
+// query must match the start of a term in the message.
+func (s *searchIndex) search(q searchQuery) []*searchDoc {
+	terms := searchTerms(q.text)
+	if len(terms) == 0 {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var matches map[string]struct{}
+	for _, term := range terms {
+		found := make(map[string]struct{})
+		start, _ := slices.BinarySearch(s.terms, term)
+		for _, indexed := range s.terms[start:] {
+			if !strings.HasPrefix(indexed, term) {
+				break
+			}
+			for key := range s.postings[indexed] {
+				if _, ok := matches[key]; ok || matches == nil {
+					found[key] = struct{}{}
+				}
+			}
+		}
+		matches = found
+		if len(matches) == 0 {
+			return nil
+		}
+	}
+	out := make([]*searchDoc, 0, len(matches))
+	for key := range matches {
+		doc := s.docs[key]
+		switch {
+		case q.room != "" && doc.room != q.room:
+		case q.from != "" && doc.from != q.from:
+		case !q.since.IsZero() && doc.time.Before(q.since):
+		case !q.until.IsZero() && !doc.time.Before(q.until):
+		default:
+			out = append(out, doc)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].time.After(out[j].time)
+	})
+	if len(out) > maxSearchResults {
+		out = out[:maxSearchResults]
+	}
+	return out
+}
+
+// indexJoinedRooms indexes the stored messages of the rooms we have joined that
+// are not indexed yet.
+func (app *App) indexJoinedRooms(ctx context.Context, cli v1.AppDaemonClient) {
+	for _, roomName := range app.joinedRooms() {
+		keys, _, err := listMessageKeys(ctx, cli, roomName)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			app.log.Error("error listing room history", "room", roomName, "error", err.Error())
+			continue
+		}
+		for _, key := range keys {
+			if app.search.has(key) {
+				continue
+			}
+			value, ok := app.storedMessage(key)
+			if !ok {
+				value, err = queryValue(ctx, cli, key)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					app.log.Error("error fetching message", "key", key, "error", err.Error())
+					continue
+				}
+				app.recordMessage(key, value)
+			}
+			app.search.add(key, app.openMessage(key, value))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"testing"
+)
+
+// addTestMessage indexes a message from a node in a room and returns it.
+func addTestMessage(t *testing.T, s *searchIndex, roomName, from, body string) (string, *ChatMessage) {
+	msg, err := NewChatMessage(from, ContentTypeText, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewMessageKey(roomName, from)
+	s.add(key, msg)
+	return key, msg
+}
+
+func TestSearchIndexPrefix(t *testing.T) {
+	s := newSearchIndex()
+	addTestMessage(t, s, "room", "a", "hello world")
+	addTestMessage(t, s, "room", "b", "help wanted")
+	if got := s.search(searchQuery{text: "hel"}); len(got) != 2 {
+		t.Fatalf("found %d messages for hel", len(got))
+	}
+	if got := s.search(searchQuery{text: "hel wor"}); len(got) != 1 {
+		t.Fatalf("found %d messages for hel wor", len(got))
+	}
+	if got := s.search(searchQuery{text: "x"}); len(got) != 0 {
+		t.Fatalf("found %d messages for x", len(got))
+	}
+}
+
+func TestSearchIndexRevisions(t *testing.T) {
+	s := newSearchIndex()
+	key, orig := addTestMessage(t, s, "room", "a", "hello")
+	// An edit claiming to be from the sender but published under another node's key
+	// is ignored.
+	forged, err := NewChatMessage("a", ContentTypeText, "forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Replaces = orig.ID
+	s.add(NewMessageKey("room", "b"), forged)
+	if got := s.search(searchQuery{text: "forged"}); len(got) != 0 {
+		t.Fatal("indexed a forged edit")
+	}
+	tombstone, err := NewChatMessage("a", ContentTypeTombstone, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstone.Replaces = orig.ID
+	s.add(NewMessageKey("room", "a"), tombstone)
+	if got := s.search(searchQuery{text: "hello"}); len(got) != 0 {
+		t.Fatal("deleted message still found")
+	}
+	if !s.has(key) {
+		t.Fatal("deleted message would be indexed again")
+	}
+	s.add(key, orig)
+	if got := s.search(searchQuery{text: "hello"}); len(got) != 0 {
+		t.Fatal("deleted message indexed again")
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"image/color"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// sparklineColumnWidth is the width in pixels given to each plotted point. Series
+// with more samples than fit are reduced to the largest value in each column.
+const sparklineColumnWidth = 2
+
+// sparkline is a line chart for one or more series of timed values sharing a
+// vertical scale.
+type sparkline struct {
+	widget.BaseWidget
+
+	mu     sync.Mutex
+	colors []color.Color
+	times  [][]time.Time
+	series [][]float64
+	// window is the duration shown, ending at the latest sample. Zero shows all samples.
+	window time.Duration
+	// format is used to render the label for the maximum value.
+	format func(float64) string
+}
+
+// newSparkline returns a new sparkline drawing a series for each of the given colors.
+func newSparkline(format func(float64) string, colors ...color.Color) *sparkline {
+	s := &sparkline{
+		colors: colors,
+		times:  make([][]time.Time, len(colors)),
+		series: make([][]float64, len(colors)),
+		format: format,
+	}
+	s.ExtendBaseWidget(s)
+	return s
+}
+
+// SetSeries replaces the values of the series at the given index. The times are
+// those of each value, in order.
+func (s *sparkline) SetSeries(index int, times []time.Time, values []float64) {
+	s.mu.Lock()
+	s.times[index] = times
+	s.series[index] = values
+	s.mu.Unlock()
+	s.Refresh()
+}
+
+// SetWindow sets the duration shown, ending at the latest sample.
+func (s *sparkline) SetWindow(d time.Duration) {
+	s.mu.Lock()
+	changed := s.window != d
+	s.window = d
+	s.mu.Unlock()
+	if changed {
+		s.Refresh()
+	}
+}
+
+// Clear removes the values of all series.
+func (s *sparkline) Clear() {
+	s.mu.Lock()
+	for i := range s.series {
+		s.times[i] = nil
+		s.series[i] = nil
+	}
+	s.mu.Unlock()
+	s.Refresh()
+}
+
+func (s *sparkline) CreateRenderer() fyne.WidgetRenderer {
+	s.ExtendBaseWidget(s)
+	bg := canvas.NewRectangle(theme.InputBackgroundColor())
+	label := canvas.NewText("", theme.PlaceHolderColor())
+	label.TextSize = theme.CaptionTextSize()
+	r := &sparklineRenderer{
+		spark: s,
+		bg:    bg,
+		label: label,
+		lines: make([][]*canvas.Line, len(s.colors)),
+	}
+	r.Refresh()
+	return r
+}
+
+type sparklineRenderer struct {
+	spark   *sparkline
+	bg      *canvas.Rectangle
+	label   *canvas.Text
+	lines   [][]*canvas.Line
+	objects []fyne.CanvasObject
+}
+
+func (r *sparklineRenderer) Layout(size fyne.Size) {
+	r.bg.Resize(size)
+	r.spark.mu.Lock()
+	defer r.spark.mu.Unlock()
+	var max float64
+	for _, values := range r.spark.series {
+		for _, v := range values {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	if r.spark.format != nil {
+		r.label.Text = r.spark.format(max)
+	}
+	r.label.Move(fyne.NewPos(theme.Padding(), 0))
+	r.label.Resize(r.label.MinSize())
+	if max == 0 {
+		// Draw a flat line along the bottom rather than dividing by zero.
+		max = 1
+	}
+	top := r.label.MinSize().Height
+	height := size.Height - top
+	start, span := r.span()
+	for i, values := range r.spark.series {
+		points := plotPoints(r.spark.times[i], values, start, span, size.Width, len(r.lines[i])+1)
+		for j, line := range r.lines[i] {
+			if j+1 >= len(points) {
+				line.Hide()
+				continue
+			}
+			line.Position1 = fyne.NewPos(points[j].X, top+height-height*points[j].Y/float32(max))
+			line.Position2 = fyne.NewPos(points[j+1].X, top+height-height*points[j+1].Y/float32(max))
+			line.Show()
+		}
+	}
+}
+
+// span returns the start and duration of the time shown. The caller must hold the lock.
+func (r *sparklineRenderer) span() (time.Time, time.Duration) {
+	var first, last time.Time
+	for _, times := range r.spark.times {
+		if len(times) == 0 {
+			continue
+		}
+		if first.IsZero() || times[0].Before(first) {
+			first = times[0]
+		}
+		if times[len(times)-1].After(last) {
+			last = times[len(times)-1]
+		}
+	}
+	if r.spark.window > 0 {
+		first = last.Add(-r.spark.window)
+	}
+	span := last.Sub(first)
+	if span <= 0 {
+		span = time.Second
+	}
+	return first, span
+}
+
+// plotPoints returns the points of a series across the given width, with x in
+// pixels and y as the value. Values are reduced to at most n points by taking the
+// largest value in each column.
+func plotPoints(times []time.Time, values []float64, start time.Time, span time.Duration, width float32, n int) []fyne.Position {
+	if n < 2 || len(values) < 2 || len(times) != len(values) {
+		return nil
+	}
+	if columns := int(width / sparklineColumnWidth); columns < n {
+		n = columns
+	}
+	if n < 2 {
+		n = 2
+	}
+	points := make([]fyne.Position, 0, n)
+	last := -1
+	for j, v := range values {
+		frac := float32(times[j].Sub(start)) / float32(span)
+		if frac < 0 {
+			continue
+		}
+		col := int(frac * float32(n-1))
+		if col > n-1 {
+			col = n - 1
+		}
+		x := width * float32(col) / float32(n-1)
+		if col == last {
+			if p := &points[len(points)-1]; float32(v) > p.Y {
+				p.Y = float32(v)
+			}
+			continue
+		}
+		last = col
+		points = append(points, fyne.NewPos(x, float32(v)))
+	}
+	return points
+}
+
+func (r *sparklineRenderer) MinSize() fyne.Size {
+	return fyne.NewSize(200, 60)
+}
+
+func (r *sparklineRenderer) Refresh() {
+	r.spark.mu.Lock()
+	columns := int(fyne.Max(r.spark.Size().Width, r.MinSize().Width) / sparklineColumnWidth)
+	for i, values := range r.spark.series {
+		want := len(values) - 1
+		if want > columns {
+			want = columns
+		}
+		if want < 0 {
+			want = 0
+		}
+		for len(r.lines[i]) < want {
+			line := canvas.NewLine(r.spark.colors[i])
+			line.StrokeWidth = 1.5
+			r.lines[i] = append(r.lines[i], line)
+		}
+		r.lines[i] = r.lines[i][:want]
+	}
+	r.objects = []fyne.CanvasObject{r.bg, r.label}
+	for _, lines := range r.lines {
+		for _, line := range lines {
+			r.objects = append(r.objects, line)
+		}
+	}
+	r.spark.mu.Unlock()
+	r.bg.FillColor = theme.InputBackgroundColor()
+	r.label.Color = theme.PlaceHolderColor()
+	r.Layout(r.spark.Size())
+	canvas.Refresh(r.spark)
+}
+
+func (r *sparklineRenderer) Objects() []fyne.CanvasObject {
+	return r.objects
+}
+
+func (r *sparklineRenderer) Destroy() {}
+
+// legendSwatch returns a small block of the given color for labelling a series.
+func legendSwatch(c color.Color) fyne.CanvasObject {
+	swatch := canvas.NewRectangle(c)
+	swatch.SetMinSize(fyne.NewSize(theme.Padding()*3, theme.Padding()*3))
+	return container.NewCenter(swatch)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	// threadPanelWidth is the width of the thread side panel.
+	threadPanelWidth = 320
+	// replyExcerptLength is the most characters of a message quoted in a reply.
+	replyExcerptLength = 80
+)
+
+// newReply returns the reply reference for a reply to the message of an entry. Replies
+// to replies belong to the same thread but quote the message replied to.
+func newReply(e *chatEntry) *ChatReply {
+	id := e.message.ID
+	if e.message.Reply != nil {
+		id = e.message.Reply.ID
+	}
+	excerpt := strings.Join(strings.Fields(e.current().displayText()), " ")
+	return &ChatReply{
+		ID:      id,
+		From:    e.message.From,
+		Excerpt: truncate(excerpt, replyExcerptLength),
+	}
+}
+
+// newThreadPanel returns the side panel showing the thread of a message.
+func (app *App) newThreadPanel() fyne.CanvasObject {
+	app.threadView = newChatView(app.nodeID, app.profiles)
+	app.threadView.Threaded = true
+	app.threadView.Menu = app.chatEntryMenu
+	app.threadView.Verify = app.verifyMessage
+	app.threadView.Thumbnail = app.thumbnail
+	app.threadView.ReactionMenu = app.reactionMenu
+	app.threadView.CopyText = app.copyText
+	app.threadInput.SetPlaceHolder("Reply to thread")
+	app.threadInput.OnSubmitted = app.onSendThreadReply
+	// The spacer gives the panel its width.
+	spacer := canvas.NewRectangle(theme.BackgroundColor())
+	spacer.SetMinSize(fyne.NewSize(threadPanelWidth, 0))
+	closeButton := widget.NewButtonWithIcon("", theme.CancelIcon(), app.closeThread)
+	title := container.New(layout.NewBorderLayout(nil, nil, nil, closeButton), closeButton, widget.NewLabel("Thread"))
+	top := container.New(layout.NewVBoxLayout(), spacer, title)
+	separator := widget.NewSeparator()
+	app.threadPanel = container.New(layout.NewBorderLayout(top, app.threadInput, separator, nil),
+		top, app.threadInput, separator, app.threadView)
+	app.threadPanel.Hide()
+	return app.threadPanel
+}
+
+// openThread shows the thread started by, or containing, the message of an entry.
+func (app *App) openThread(e *chatEntry) {
+	if e.message == nil {
+		return
+	}
+	app.threadParent = newReply(e).ID
+	app.threadView.Clear()
+	app.renderThread()
+	app.threadPanel.Show()
+	app.chatGrid.Refresh()
+}
+
+// closeThread hides the thread side panel.
+func (app *App) closeThread() {
+	app.threadParent = ""
+	app.threadInput.SetText("")
+	app.threadPanel.Hide()
+	app.threadView.Clear()
+	app.chatGrid.Refresh()
+}
+
+// renderThread renders the open thread from the selected room's transcript.
+func (app *App) renderThread() {
+	transcript := app.transcript.Load()
+	if transcript == nil || app.threadParent == "" {
+		return
+	}
+	app.threadView.SetEntries(transcript.thread(app.threadParent))
+}
+
+// onReply starts a reply to the message of an entry from the chat input.
+func (app *App) onReply(e *chatEntry) {
+	app.replyingTo = e
+	name, _ := app.profiles.name(e.message.From)
+	app.replyLabel.SetText("Replying to " + name + ": " + newReply(e).Excerpt)
+	app.replyBar.Show()
+	app.main.Canvas().Focus(app.chatInput)
+}
+
+// cancelReply stops replying from the chat input.
+func (app *App) cancelReply() {
+	app.replyingTo = nil
+	app.replyLabel.SetText("")
+	app.replyBar.Hide()
+}
+
+// onSendThreadReply sends a reply to the open thread.
+func (app *App) onSendThreadReply(s string) {
+	transcript := app.transcript.Load()
+	if strings.TrimSpace(s) == "" || app.threadParent == "" || transcript == nil {
+		return
+	}
+	thread := transcript.thread(app.threadParent)
+	if len(thread) == 0 {
+		return
+	}
+	app.markActive()
+	nodeID, _ := app.nodeID.Get()
+	msg, err := NewChatMessage(nodeID, app.messageContentType(), s)
+	if err != nil {
+		app.log.Error("error creating message", "error", err.Error())
+		return
+	}
+	// Replies from the panel quote the first loaded message of the thread.
+	msg.Reply = newReply(thread[0])
+	msg.Reply.ID = app.threadParent
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := app.sendMessage(ctx, app.selectedRoom, msg); err != nil {
+		app.log.Error("error sending message", "error", err.Error())
+		if errors.Is(err, errRoomLocked) {
+			dialog.ShowError(err, app.main)
+		}
+		return
+	}
+	app.threadInput.SetText("")
+}
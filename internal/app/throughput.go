@@ -0,0 +1,154 @@
+/*
+Copyright 2023 Avi Zimmerman <avi.zimmerman@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"sync"
+	"time"
+
+	v1 "github.com/webmeshproj/api/v1"
+)
+
+// throughputWindows are the selectable windows for the throughput graph.
+var throughputWindows = map[string]time.Duration{
+	"1m":  time.Minute,
+	"15m": time.Minute * 15,
+	"1h":  time.Hour,
+}
+
+// throughputWindowOptions are the throughput window names in display order.
+var throughputWindowOptions = []string{"1m", "15m", "1h"}
+
+// maxThroughputWindow is the longest window of samples retained.
+const maxThroughputWindow = time.Hour
+
+// throughputSample is a transfer rate computed between two interface metrics samples.
+type throughputSample struct {
+	// time is the time of the later of the two samples.
+	time time.Time
+	// sendRate is the transmit rate in bytes per second.
+	sendRate float64
+	// recvRate is the receive rate in bytes per second.
+	recvRate float64
+}
+
+// throughputTracker computes transfer rates from successive interface metrics.
+type throughputTracker struct {
+	mu       sync.Mutex
+	lastTime time.Time
+	counters interfaceCounters
+	samples  []throughputSample
+}
+
+// observe records the given metrics and returns the rate since the previous
+// observation. The returned bool is false for the first observation.
+func (t *throughputTracker) observe(now time.Time, metrics *v1.InterfaceMetrics) (throughputSample, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sent, recv, ok := t.counters.delta(metrics)
+	prevTime := t.lastTime
+	t.lastTime = now
+	if !ok {
+		return throughputSample{}, false
+	}
+	elapsed := now.Sub(prevTime).Seconds()
+	if elapsed <= 0 {
+		return throughputSample{}, false
+	}
+	sample := throughputSample{
+		time:     now,
+		sendRate: float64(sent) / elapsed,
+		recvRate: float64(recv) / elapsed,
+	}
+	t.samples = append(t.samples, sample)
+	// Drop samples that have aged out of the longest window.
+	cutoff := now.Add(-maxThroughputWindow)
+	var i int
+	for i < len(t.samples) && t.samples[i].time.Before(cutoff) {
+		i++
+	}
+	t.samples = t.samples[i:]
+	return sample, true
+}
+
+// window returns the samples that fall within the given duration of the latest sample.
+func (t *throughputTracker) window(d time.Duration) []throughputSample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) == 0 {
+		return nil
+	}
+	cutoff := t.samples[len(t.samples)-1].time.Add(-d)
+	for i, s := range t.samples {
+		if !s.time.Before(cutoff) {
+			out := make([]throughputSample, len(t.samples)-i)
+			copy(out, t.samples[i:])
+			return out
+		}
+	}
+	return nil
+}
+
+// reset clears all recorded samples.
+func (t *throughputTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastTime = time.Time{}
+	t.counters.reset()
+	t.samples = nil
+}
+
+// interfaceCounters tracks the raw transfer counters of the interface between samples.
+type interfaceCounters struct {
+	seen   bool
+	device string
+	key    string
+	sent   uint64
+	recv   uint64
+}
+
+// delta returns the bytes sent and received since the previous sample. The returned
+// bool is false for the first sample since creation or the last reset.
+func (c *interfaceCounters) delta(metrics *v1.InterfaceMetrics) (sent, recv uint64, ok bool) {
+	prevSent, prevRecv := c.sent, c.recv
+	if metrics.GetDeviceName() != c.device || metrics.GetPublicKey() != c.key {
+		// The interface was recreated, so the counters started over from zero.
+		prevSent, prevRecv = 0, 0
+	}
+	ok = c.seen
+	c.seen = true
+	c.device, c.key = metrics.GetDeviceName(), metrics.GetPublicKey()
+	c.sent, c.recv = metrics.GetTotalTransmitBytes(), metrics.GetTotalReceiveBytes()
+	if !ok {
+		return 0, 0, false
+	}
+	return counterDelta(prevSent, c.sent), counterDelta(prevRecv, c.recv), true
+}
+
+// reset forgets the previous sample.
+func (c *interfaceCounters) reset() {
+	*c = interfaceCounters{}
+}
+
+// counterDelta returns the increase of a monotonic counter between two samples.
+// If the counter went backwards it is assumed to have been reset to zero.
+func counterDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}